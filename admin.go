@@ -0,0 +1,92 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// adminServer serves the operational endpoints on -admin-addr. It runs on
+// every instance, not only the leader.
+type adminServer struct {
+	Addr string
+	Log  logr.Logger
+
+	mux *http.ServeMux
+}
+
+func newAdminServer(addr string, log logr.Logger) *adminServer {
+	return &adminServer{Addr: addr, Log: log, mux: http.NewServeMux()}
+}
+
+// HandleJSON serves the result of fn as JSON on path.
+func (s *adminServer) HandleJSON(path string, fn func() (interface{}, error)) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		v, err := fn()
+		if err != nil {
+			s.Log.Error(err, "admin request failed", "path", path)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			s.Log.Error(err, "could not write admin response", "path", path)
+		}
+	})
+}
+
+// Handle serves handler on path.
+func (s *adminServer) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// HandleCheck serves ok on path while fn succeeds, and 503 with its error
+// otherwise.
+func (s *adminServer) HandleCheck(path string, fn func() error) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// Start serves until stop is closed. It implements manager.Runnable.
+func (s *adminServer) Start(stop <-chan struct{}) error {
+	srv := &http.Server{Addr: s.Addr, Handler: s.mux}
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	s.Log.Info("serving admin endpoints", "addr", s.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (s *adminServer) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,49 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestAdminConfigRedacts(t *testing.T) {
+	const channel = "https://token@example.com/tag"
+	cfg := testConfig(t, "-image-channel="+channel)
+	admin := newAdminServer(":0", ctrl.Log.WithName("test"))
+	admin.HandleJSON("/config", func() (interface{}, error) { return cfg.Effective(), nil })
+
+	w := httptest.NewRecorder()
+	admin.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); strings.Contains(body, "token") {
+		t.Errorf("/config leaks the image channel: %s", body)
+	}
+	var got map[string]effectiveSetting
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if v := got["image-channel"]; v.Value != redacted || v.Source != sourceFlag {
+		t.Errorf("image-channel = %+v, want it redacted and set by flag", v)
+	}
+}
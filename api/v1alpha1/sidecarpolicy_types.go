@@ -0,0 +1,55 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SidecarPolicySpec defines the desired state of SidecarPolicy
+type SidecarPolicySpec struct {
+	// Selector picks the Deployments of the policy's namespace that get the
+	// sidecar. An empty selector picks all of them.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// Sidecar is the container injected into the selected Deployments. Its
+	// name must be node-sidecar or left empty.
+	Sidecar corev1.Container `json:"sidecar"`
+}
+
+// +kubebuilder:object:root=true
+
+// SidecarPolicy is the Schema for the sidecarpolicies API
+type SidecarPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SidecarPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// SidecarPolicyList contains a list of SidecarPolicy
+type SidecarPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SidecarPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SidecarPolicy{}, &SidecarPolicyList{})
+}
@@ -0,0 +1,147 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Decisions written to the audit log.
+const (
+	decisionInject = "inject"
+	decisionUpdate = "update"
+	decisionSkip   = "skip"
+	decisionRemove = "remove"
+)
+
+// auditRecord is one JSON line of the audit log.
+type auditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// auditLog appends reconcile decisions to a file as JSON lines. A decision is
+// only written when it differs from the last one written for the same object,
+// so a Deployment that keeps being skipped for the same reason is logged once.
+// When the file would grow past maxSize it is rotated to <path>.1.
+//
+// A nil *auditLog discards every record.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	last map[auditKey]string
+}
+
+// auditKey identifies an object of the audit log, a ReplicaSet may have the
+// name of a Deployment.
+type auditKey struct {
+	Kind string
+	types.NamespacedName
+}
+
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, last: map[auditKey]string{}}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// record appends decision for key of kind unless it repeats the previous
+// one.
+func (l *auditLog) record(kind string, key types.NamespacedName, decision, reason string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last[auditKey{kind, key}] == decision+"/"+reason {
+		return nil
+	}
+
+	line, err := json.Marshal(auditRecord{
+		Timestamp: time.Now().UTC(),
+		Kind:      kind,
+		Namespace: key.Namespace,
+		Name:      key.Name,
+		Decision:  decision,
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.last[auditKey{kind, key}] = decision + "/" + reason
+	return nil
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// forget drops the last decision of key of kind, e.g. because the object was
+// deleted.
+func (l *auditLog) forget(kind string, key types.NamespacedName) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.last, auditKey{kind, key})
+}
@@ -0,0 +1,134 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testAuditLog opens an audit log rotated past maxSize in a new directory,
+// removed by the returned func.
+func testAuditLog(t *testing.T, maxSize int64) (*auditLog, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	l, err := openAuditLog(path, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return l, path, func() { l.file.Close(); os.RemoveAll(dir) }
+}
+
+// readAudit returns the records of the audit log at path.
+func readAudit(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []auditRecord
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestReconcileAudit(t *testing.T) {
+	l, path, cleanup := testAuditLog(t, 0)
+	defer cleanup()
+	a := testReconciler(testConfig(t, "-remove-on-opt-out"), testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	a.AuditLog = l
+	reconcile := func() {
+		t.Helper()
+		if _, err := a.Reconcile(request("web")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcile()
+	reconcile()
+	dep := stored(t, a.Client, "web")
+	dep.Labels["node-sidecar"] = "false"
+	if err := a.Update(context.TODO(), dep.Object); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	reconcile()
+
+	records := readAudit(t, path)
+	var decisions []string
+	for _, record := range records {
+		if record.Kind != "deployment" || record.Namespace != "default" || record.Name != "web" || record.Timestamp.IsZero() {
+			t.Errorf("record %+v, want one of deployment default/web", record)
+		}
+		decisions = append(decisions, record.Decision+"/"+record.Reason)
+	}
+	want := []string{decisionInject + "/", decisionRemove + "/", decisionSkip + "/" + skipSelectorMismatch}
+	if len(decisions) != len(want) {
+		t.Fatalf("decisions %q, want %q", decisions, want)
+	}
+	for i := range want {
+		if decisions[i] != want[i] {
+			t.Errorf("decisions %q, want %q", decisions, want)
+		}
+	}
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	l, path, cleanup := testAuditLog(t, 300)
+	defer cleanup()
+	key := types.NamespacedName{Namespace: "default", Name: "web"}
+	for _, decision := range []string{decisionInject, decisionUpdate, decisionRemove} {
+		if err := l.record("deployment", key, decision, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated := readAudit(t, path+".1")
+	current := readAudit(t, path)
+	if len(rotated) == 0 || len(current) == 0 || len(rotated)+len(current) != 3 {
+		t.Fatalf("%d records rotated and %d current, want all 3 split between them", len(rotated), len(current))
+	}
+	if last := current[len(current)-1]; last.Decision != decisionRemove {
+		t.Errorf("last record %+v, want the removal", last)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+		t.Errorf("audit log grew past its max size: %v, %v", info, err)
+	}
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var l *auditLog
+	if err := l.record("deployment", types.NamespacedName{Namespace: "default", Name: "web"}, decisionInject, ""); err != nil {
+		t.Errorf("record() = %v", err)
+	}
+	l.forget("deployment", types.NamespacedName{Namespace: "default", Name: "web"})
+}
@@ -0,0 +1,206 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const configMapChannelPrefix = "configmap:"
+
+// imageChannel supplies the desired sidecar image tag from a source, either a
+// ConfigMap key, written as configmap:<namespace>/<name>/<key>, which is
+// watched, or an http(s) endpoint whose body is the tag, which is polled every
+// Interval. When the tag changes Enqueue is called so every injected
+// Deployment gets re-injected with the new tag.
+type imageChannel struct {
+	Source   string
+	Interval time.Duration
+	// Reader reads the ConfigMap once, for refresh, and ConfigMaps watches it.
+	Reader     client.Reader
+	ConfigMaps toolscache.ListerWatcher
+	Enqueue    func() error
+	Log        logr.Logger
+
+	configMap types.NamespacedName
+	key       string
+
+	client *http.Client
+
+	mu  sync.RWMutex
+	tag string
+}
+
+// channelTimeout bounds a single read of an http(s) image channel, so a hung
+// endpoint doesn't stop the polling.
+const channelTimeout = 10 * time.Second
+
+// newImageChannel validates the source and returns a channel ready to be added
+// to the manager.
+func newImageChannel(source string, interval time.Duration) (*imageChannel, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("image channel interval must be positive, got %v", interval)
+	}
+	c := &imageChannel{Source: source, Interval: interval, client: &http.Client{Timeout: channelTimeout}}
+	switch {
+	case strings.HasPrefix(source, configMapChannelPrefix):
+		parts := strings.Split(strings.TrimPrefix(source, configMapChannelPrefix), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("image channel %q must look like configmap:<namespace>/<name>/<key>", source)
+		}
+		c.configMap = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		c.key = parts[2]
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+	default:
+		return nil, fmt.Errorf("image channel %q must be a configmap: source or an http(s) URL", source)
+	}
+	return c, nil
+}
+
+// watchConfigMap makes the channel watch its ConfigMap through clientset, and
+// only that ConfigMap rather than caching every ConfigMap of the cluster.
+func (c *imageChannel) watchConfigMap(clientset kubernetes.Interface) {
+	selector := fields.OneTermEqualSelector("metadata.name", c.configMap.Name).String()
+	configMaps := clientset.CoreV1().ConfigMaps(c.configMap.Namespace)
+	c.ConfigMaps = &toolscache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return configMaps.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return configMaps.Watch(options)
+		},
+	}
+}
+
+// Tag returns the last tag read from the channel, or "" if none was read yet.
+func (c *imageChannel) Tag() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tag
+}
+
+// Start watches or polls the channel until stop is closed. It implements
+// manager.Runnable.
+func (c *imageChannel) Start(stop <-chan struct{}) error {
+	if c.key != "" {
+		_, informer := toolscache.NewInformer(c.ConfigMaps, &core.ConfigMap{}, 0, toolscache.ResourceEventHandlerFuncs{
+			AddFunc:    c.observe,
+			UpdateFunc: func(_, obj interface{}) { c.observe(obj) },
+		})
+		informer.Run(stop)
+		return nil
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		c.poll()
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh reads the channel once, without enqueueing anything, e.g. for a
+// report that has to know the tag before it can evaluate Deployments.
+func (c *imageChannel) refresh() error {
+	tag, err := c.read()
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		c.mu.Lock()
+		c.tag = tag
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// observe takes the tag from a watched ConfigMap.
+func (c *imageChannel) observe(obj interface{}) {
+	if cm, ok := obj.(*core.ConfigMap); ok {
+		c.set(strings.TrimSpace(cm.Data[c.key]))
+	}
+}
+
+func (c *imageChannel) poll() {
+	tag, err := c.read()
+	if err != nil {
+		c.Log.Error(err, "could not read image channel", "source", c.Source)
+		return
+	}
+	c.set(tag)
+}
+
+// set records tag and re-injects the injected Deployments when it changed.
+func (c *imageChannel) set(tag string) {
+	if tag == "" || tag == c.Tag() {
+		return
+	}
+
+	c.mu.Lock()
+	c.tag = tag
+	c.mu.Unlock()
+	c.Log.Info("sidecar image tag changed, re-injecting", "tag", tag)
+
+	if err := c.Enqueue(); err != nil {
+		c.Log.Error(err, "could not enqueue injected deployments")
+	}
+}
+
+func (c *imageChannel) read() (string, error) {
+	if c.key != "" {
+		cm := &core.ConfigMap{}
+		if err := c.Reader.Get(context.TODO(), c.configMap, cm); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(cm.Data[c.key]), nil
+	}
+
+	resp, err := c.client.Get(c.Source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("image channel returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,155 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestNewImageChannel(t *testing.T) {
+	tests := []struct {
+		source   string
+		interval time.Duration
+		wantErr  bool
+	}{
+		{source: "configmap:ops/sidecar/tag", interval: time.Minute},
+		{source: "https://example.com/tag", interval: time.Minute},
+		{source: "configmap:ops/sidecar", interval: time.Minute, wantErr: true},
+		{source: "configmap:ops//tag", interval: time.Minute, wantErr: true},
+		{source: "ftp://example.com/tag", interval: time.Minute, wantErr: true},
+		{source: "https://example.com/tag", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s every %v", tt.source, tt.interval), func(t *testing.T) {
+			if _, err := newImageChannel(tt.source, tt.interval); (err != nil) != tt.wantErr {
+				t.Errorf("newImageChannel() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageChannelHTTP(t *testing.T) {
+	tag := "1.0"
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintln(w, tag)
+	}))
+	defer server.Close()
+
+	c, err := newImageChannel(server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueued := 0
+	c.Enqueue = func() error { enqueued++; return nil }
+	c.Log = ctrl.Log.WithName("test")
+
+	steps := []struct {
+		tag          string
+		status       int
+		wantTag      string
+		wantEnqueued int
+	}{
+		{tag: "1.0", status: http.StatusOK, wantTag: "1.0", wantEnqueued: 1},
+		{tag: "1.0", status: http.StatusOK, wantTag: "1.0", wantEnqueued: 1},
+		{tag: "2.0", status: http.StatusInternalServerError, wantTag: "1.0", wantEnqueued: 1},
+		{tag: "", status: http.StatusOK, wantTag: "1.0", wantEnqueued: 1},
+		{tag: "2.0", status: http.StatusOK, wantTag: "2.0", wantEnqueued: 2},
+	}
+	for i, step := range steps {
+		tag, status = step.tag, step.status
+		c.poll()
+		if c.Tag() != step.wantTag || enqueued != step.wantEnqueued {
+			t.Errorf("poll %d: tag %q after %d enqueues, want %q after %d", i, c.Tag(), enqueued, step.wantTag, step.wantEnqueued)
+		}
+	}
+}
+
+func TestImageChannelConfigMap(t *testing.T) {
+	cm := &core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "sidecar"},
+		Data:       map[string]string{"tag": " 3.1\n"},
+	}
+	c, err := newImageChannel("configmap:ops/sidecar/tag", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Reader = fake.NewFakeClientWithScheme(scheme, cm)
+	if err := c.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tag() != "3.1" {
+		t.Errorf("Tag() = %q, want 3.1", c.Tag())
+	}
+}
+
+func TestImageChannelWatchReinjects(t *testing.T) {
+	cm := &core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "sidecar"},
+		Data:       map[string]string{"tag": "1.0"},
+	}
+	clientset := kubefake.NewSimpleClientset(cm)
+	c, err := newImageChannel("configmap:ops/sidecar/tag", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.watchConfigMap(clientset)
+	c.Log = ctrl.Log.WithName("test")
+
+	events := make(chan event.GenericEvent, 1)
+	a := testReconciler(testConfig(t), testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	a.Events = events
+	a.ImageChannel = c
+	c.Enqueue = a.enqueueInjected
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Start(stop)
+
+	// every new tag re-injects the Deployment
+	for _, tag := range []string{"1.0", "2.0"} {
+		if tag != "1.0" {
+			cm.Data["tag"] = tag
+			if _, err := clientset.CoreV1().ConfigMaps("ops").Update(cm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case e := <-events:
+			if _, err := a.Reconcile(request(e.Meta.GetName())); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tag %s not picked up", tag)
+		}
+		dep := stored(t, a.Client, "web")
+		if image := dep.Template.Spec.Containers[sidecarIndex(&dep.Template.Spec)].Image; image != sidecarImageRepository+":"+tag {
+			t.Errorf("sidecar image %s, want tag %s", image, tag)
+		}
+	}
+}
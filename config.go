@@ -0,0 +1,735 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceFlag    = "flag"
+)
+
+// Values of -sidecar-source-precedence.
+const (
+	precedenceConfigMap = "configmap"
+	precedenceFile      = "file"
+)
+
+// Config holds every injector setting. Each field is set in the -config file
+// under the json name of the field, which is always the name of its flag.
+// Flags given on the command line override the file.
+type Config struct {
+	ConfigFile string `json:"-"`
+
+	// Manager
+	MetricsAddr          string `json:"metrics-addr"`
+	EnableLeaderElection bool   `json:"enable-leader-election"`
+	PodCountBestEffort   bool   `json:"pod-count-best-effort"`
+	PodCountFormat       string `json:"pod-count-format"`
+	ShardCount           int    `json:"shard-count"`
+	ShardIndex           int    `json:"shard-index"`
+	PreferAppsV1         bool   `json:"prefer-apps-v1"`
+	AdminAddr            string `json:"admin-addr"`
+	Report               bool   `json:"report"`
+
+	CountDiscrepancyThreshold int             `json:"count-discrepancy-threshold"`
+	CountDiscrepancyRequeue   metav1.Duration `json:"count-discrepancy-requeue"`
+
+	DisablePerObjectMetrics bool    `json:"disable-per-object-metrics"`
+	EnableExemplars         bool    `json:"enable-exemplars"`
+	InstanceID              string  `json:"instance-id"`
+	ForeignInjector         string  `json:"foreign-injector"`
+	ClusterName             string  `json:"cluster-name"`
+	BackfillRate            float64 `json:"backfill-rate"`
+	FieldManager            string  `json:"field-manager"`
+	ServerSideApply         bool    `json:"server-side-apply"`
+	GitOpsIgnore            bool    `json:"gitops-ignore"`
+	PerObjectRate           float64 `json:"per-object-rate"`
+	PerObjectBurst          int     `json:"per-object-burst"`
+
+	ReconcileStalenessLimit metav1.Duration `json:"reconcile-staleness-limit"`
+
+	// Manager start retries
+	StartRetries                int             `json:"start-retries"`
+	StartRetryBackoff           metav1.Duration `json:"start-retry-backoff"`
+	LeaderElectionLeaseDuration metav1.Duration `json:"leader-election-lease-duration"`
+	LeaderElectionRenewDeadline metav1.Duration `json:"leader-election-renew-deadline"`
+
+	// Conflict retries
+	ConflictRetrySteps    int             `json:"conflict-retry-steps"`
+	ConflictRetryDuration metav1.Duration `json:"conflict-retry-duration"`
+	ConflictRetryFactor   float64         `json:"conflict-retry-factor"`
+	ConflictRetryJitter   float64         `json:"conflict-retry-jitter"`
+
+	// Which Deployments get the sidecar
+	NamespaceInjection       bool   `json:"namespace-injection"`
+	EnablePolicies           bool   `json:"enable-policies"`
+	PrimaryContainer         string `json:"primary-container"`
+	AllowHostNetwork         bool   `json:"allow-host-network"`
+	AnnotateSkipReason       bool   `json:"annotate-skip-reason"`
+	ActiveRevisionAnnotation string `json:"active-revision-annotation"`
+	RequireOwnerKind         string `json:"require-owner-kind"`
+	RequireOwnerName         string `json:"require-owner-name"`
+	RequireServiceAccount    string `json:"require-service-account"`
+	SetServiceAccount        bool   `json:"set-service-account"`
+	SkipIfEnv                string `json:"skip-if-env"`
+	AllowSelfInject          bool   `json:"allow-self-inject"`
+	InjectReplicaSets        bool   `json:"inject-replicasets"`
+
+	// The sidecar container
+	SidecarConfig           string          `json:"sidecar-config"`
+	SidecarConfigMap        string          `json:"sidecar-configmap"`
+	SidecarSourcePrecedence string          `json:"sidecar-source-precedence"`
+	VerifyImage             bool            `json:"verify-image"`
+	ImageChannel            string          `json:"image-channel" redact:"true"`
+	ImageChannelInterval    metav1.Duration `json:"image-channel-interval"`
+	SidecarImagePullPolicy  string          `json:"sidecar-image-pull-policy"`
+	SidecarCommand          []string        `json:"sidecar-command"`
+	SidecarArgs             []string        `json:"sidecar-args"`
+	SidecarCPURequest       string          `json:"sidecar-cpu-request"`
+	SidecarMemoryRequest    string          `json:"sidecar-memory-request"`
+	SidecarCPULimit         string          `json:"sidecar-cpu-limit"`
+	SidecarMemoryLimit      string          `json:"sidecar-memory-limit"`
+	SidecarRequestsOnly     bool            `json:"sidecar-requests-only"`
+	SidecarResourceRatio    float64         `json:"sidecar-resource-ratio"`
+	ReplicaScaledResources  string          `json:"replica-scaled-resources"`
+	SidecarCritical         bool            `json:"sidecar-critical"`
+	SidecarTCPProbe         bool            `json:"sidecar-tcp-probe"`
+	SidecarPreStopSleep     metav1.Duration `json:"sidecar-prestop-sleep"`
+	SummaryEvent            bool            `json:"summary-event"`
+	CoupleReadiness         bool            `json:"couple-readiness"`
+	CoupleReadinessPath     string          `json:"couple-readiness-path"`
+	RestartAnnotation       string          `json:"restart-annotation"`
+	RemoveOnOptOut          bool            `json:"remove-on-opt-out"`
+	RestartOnRemoval        bool            `json:"restart-on-removal"`
+	ReinjectOnDrift         bool            `json:"reinject-on-drift"`
+	SidecarRunAsUser        int64           `json:"sidecar-run-as-user"`
+	SidecarRunAsGroup       int64           `json:"sidecar-run-as-group"`
+	SidecarFSGroup          int64           `json:"sidecar-fs-group"`
+	PrewarmSidecar          bool            `json:"prewarm-sidecar"`
+	PrewarmCommand          []string        `json:"prewarm-command"`
+
+	// Log sidecar mode
+	LogSidecar        bool     `json:"log-sidecar"`
+	LogSidecarPath    string   `json:"log-sidecar-path"`
+	LogSidecarImage   string   `json:"log-sidecar-image"`
+	LogSidecarCommand []string `json:"log-sidecar-command"`
+
+	// Auditing
+	AuditLog        string `json:"audit-log"`
+	AuditLogMaxSize int64  `json:"audit-log-max-size"`
+
+	// Sources records where each setting came from, keyed by flag name.
+	Sources map[string]string `json:"-"`
+	// SidecarBase is the container loaded from SidecarConfig and
+	// SidecarConfigMap.
+	SidecarBase *core.Container `json:"-"`
+}
+
+// bindFlags registers a flag for every setting, writing into c.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	fs.BoolVar(&c.EnableLeaderElection, "enable-leader-election", false,
+		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	fs.BoolVar(&c.PodCountBestEffort, "pod-count-best-effort", false,
+		"Treat the pod-count label as best effort. A failed pod-count update only requeues the Deployment instead of failing the reconcile.")
+	fs.StringVar(&c.PodCountFormat, "pod-count-format", "%d",
+		"Format of the pod-count value, with a single %d for the count. Values that aren't valid label values are written as an annotation instead.")
+	fs.IntVar(&c.ShardCount, "shard-count", 1, "Number of shards the Deployments are split into, each handled by its own injector instances.")
+	fs.IntVar(&c.ShardIndex, "shard-index", 0, "Shard handled by this instance, from 0 to shard-count-1.")
+	fs.BoolVar(&c.PreferAppsV1, "prefer-apps-v1", false,
+		"Watch Deployments in apps/v1 instead of the deprecated extensions/v1beta1, so a Deployment served by both groups is reconciled once.")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "The address the admin endpoints bind to. Disabled when empty.")
+	fs.BoolVar(&c.Report, "report", false,
+		"Print what would be done with every Deployment as a table once the cache synced, then exit without changing anything.")
+	fs.IntVar(&c.CountDiscrepancyThreshold, "count-discrepancy-threshold", 0,
+		"Log a warning when the pod count differs from the replicas in the Deployment status by more than this, e.g. mid-rollout or with stuck pods. Disabled when 0.")
+	fs.DurationVar(&c.CountDiscrepancyRequeue.Duration, "count-discrepancy-requeue", 30*time.Second,
+		"Check a Deployment whose pod count diverged from its status again after this long. Not requeued when 0.")
+	fs.BoolVar(&c.DisablePerObjectMetrics, "disable-per-object-metrics", false,
+		"Don't export metrics with a series per Deployment, to keep the metric cardinality down on large clusters.")
+	fs.BoolVar(&c.EnableExemplars, "enable-exemplars", false,
+		"Serve the rollout duration histogram with the Deployment of the latest observation of every bucket as its exemplar, on /metrics/exemplars of -admin-addr.")
+	fs.StringVar(&c.InstanceID, "instance-id", defaultInstanceID(),
+		"Identity of this injector, recorded on the Deployments it injects. Defaults to the name of the Deployment it runs in, taken from $POD_NAME or the hostname.")
+	fs.StringVar(&c.ForeignInjector, "foreign-injector", foreignAdopt,
+		"What to do with a Deployment injected by another injector instance: adopt it, or skip it.")
+	fs.StringVar(&c.ClusterName, "cluster-name", "",
+		"Name of the cluster the injector runs in. Deployments whose node-sidecar/clusters annotation doesn't list it are skipped.")
+	fs.Float64Var(&c.BackfillRate, "backfill-rate", 0,
+		"Deployments per second re-enqueued when every injected Deployment has to be reconciled again, e.g. after the image channel moved on. Unlimited when 0.")
+	fs.StringVar(&c.FieldManager, "field-manager", "node-sidecar-injector",
+		"Field manager the injector's changes to Deployments are recorded under, e.g. for GitOps tools ignoring the fields it manages.")
+	fs.BoolVar(&c.ServerSideApply, "server-side-apply", false,
+		"Write Deployments with a server-side apply of only the fields the injector sets, instead of updating them as a whole. Needs an API server with server-side apply enabled.")
+	fs.BoolVar(&c.GitOpsIgnore, "gitops-ignore", false,
+		"Annotate injected Deployments with node-sidecar/gitops-ignore, for GitOps tools to ignore the difference to their manifests.")
+	fs.Float64Var(&c.PerObjectRate, "per-object-rate", 0,
+		"Reconciles per second allowed for a single Deployment. Faster reconciles, e.g. from another controller fighting over the Deployment, are delayed. Unlimited when 0.")
+	fs.IntVar(&c.PerObjectBurst, "per-object-burst", 5,
+		"Reconciles of a single Deployment allowed in a burst above -per-object-rate.")
+	fs.DurationVar(&c.ReconcileStalenessLimit.Duration, "reconcile-staleness-limit", 0,
+		"Stop changing Deployments once reconciles kept failing for this long, until one succeeds against the API server again. Disabled when 0.")
+
+	fs.IntVar(&c.StartRetries, "start-retries", 3,
+		"How often the manager is started again after it failed with a recoverable error, like a transient API server error. A lost leader election always exits.")
+	fs.DurationVar(&c.StartRetryBackoff.Duration, "start-retry-backoff", time.Second, "Backoff before the first restart of the manager, doubled after every restart.")
+	fs.DurationVar(&c.LeaderElectionLeaseDuration.Duration, "leader-election-lease-duration", 15*time.Second,
+		"How long candidates wait for the leader to renew its lease before taking over.")
+	fs.DurationVar(&c.LeaderElectionRenewDeadline.Duration, "leader-election-renew-deadline", 10*time.Second,
+		"How long the leader tries to renew its lease before giving up leadership.")
+
+	fs.IntVar(&c.ConflictRetrySteps, "conflict-retry-steps", 5, "How often a Deployment update is tried when it conflicts with another writer.")
+	fs.DurationVar(&c.ConflictRetryDuration.Duration, "conflict-retry-duration", 10*time.Millisecond, "Initial backoff between conflicting updates.")
+	fs.Float64Var(&c.ConflictRetryFactor, "conflict-retry-factor", 2, "Factor the conflict backoff grows by after every try.")
+	fs.Float64Var(&c.ConflictRetryJitter, "conflict-retry-jitter", 0.5,
+		"Random extra backoff of up to this fraction of the backoff, so concurrent writers don't retry in lockstep.")
+
+	fs.BoolVar(&c.NamespaceInjection, "namespace-injection", false,
+		"Also inject Deployments without a node-sidecar label of their own in namespaces labelled node-sidecar=true.")
+	fs.BoolVar(&c.EnablePolicies, "enable-policies", false,
+		"Inject the Deployments selected by a SidecarPolicy of their namespace with the sidecar it declares, instead of the node-sidecar label and the sidecar flags.")
+	fs.StringVar(&c.PrimaryContainer, "primary-container", "",
+		"Name of the app container the sidecar is configured against: the one -sidecar-resource-ratio sizes it by, and the only one the shared log and readiness volumes are mounted in. Deployments without it are skipped. Defaults to the first app container for sizing, and to all of them for the volumes.")
+	fs.BoolVar(&c.AllowHostNetwork, "allow-host-network", false,
+		"Inject into Deployments using hostNetwork. The sidecar ports are then declared as host ports, so the scheduler only places the pods where they are free.")
+	fs.BoolVar(&c.AnnotateSkipReason, "annotate-skip-reason", false,
+		"Record why a Deployment was not injected in its node-sidecar/skip-reason annotation.")
+	fs.StringVar(&c.ActiveRevisionAnnotation, "active-revision-annotation", "",
+		"Only inject Deployments with this annotation set to \"true\", e.g. the active revision of a blue/green rollout.")
+	fs.StringVar(&c.RequireOwnerKind, "require-owner-kind", "",
+		"Only inject Deployments with an owner reference of this kind, or whose app.kubernetes.io/managed-by label names it.")
+	fs.StringVar(&c.RequireOwnerName, "require-owner-name", "",
+		"Only inject Deployments with an owner reference of this name, or whose app.kubernetes.io/managed-by label names it.")
+	fs.StringVar(&c.RequireServiceAccount, "require-service-account", "",
+		"Only inject Deployments whose pods run as this service account.")
+	fs.BoolVar(&c.SetServiceAccount, "set-service-account", false,
+		"Set -require-service-account on Deployments that don't name a service account, instead of skipping them.")
+	fs.StringVar(&c.SkipIfEnv, "skip-if-env", "",
+		"Don't inject Deployments with an app container setting this environment variable, e.g. one that already does what the sidecar does.")
+	fs.BoolVar(&c.AllowSelfInject, "allow-self-inject", false,
+		"Inject the Deployment the injector runs in as well. It is skipped by default, as restarting it for the sidecar restarts the injector.")
+	fs.BoolVar(&c.InjectReplicaSets, "inject-replicasets", false,
+		"Also inject ReplicaSets that aren't controlled by a Deployment. Only pods they create afterwards get the sidecar.")
+
+	fs.StringVar(&c.SidecarConfig, "sidecar-config", "",
+		"Path to a YAML container spec the sidecar is built from instead of the built-in one. The sidecar flags are applied on top.")
+	fs.StringVar(&c.SidecarConfigMap, "sidecar-configmap", "",
+		"ConfigMap key with a YAML container spec the sidecar is built from, written as <namespace>/<name>/<key>. Merged with -sidecar-config when both are set.")
+	fs.StringVar(&c.SidecarSourcePrecedence, "sidecar-source-precedence", precedenceConfigMap,
+		"Which of -sidecar-configmap and -sidecar-config wins for the fields both set: configmap or file.")
+	fs.BoolVar(&c.VerifyImage, "verify-image", false,
+		"Only inject the sidecar once its image was found in the registry. Images are verified when first injected, e.g. after the image channel moved on.")
+	fs.StringVar(&c.ImageChannel, "image-channel", "",
+		"Source of the desired sidecar image tag, either a watched configmap:<namespace>/<name>/<key> or a polled http(s) URL. Injected Deployments are re-injected when the tag changes.")
+	fs.DurationVar(&c.ImageChannelInterval.Duration, "image-channel-interval", time.Minute,
+		"How often an http(s) image channel is polled, and how long reconciles wait to retry until the channel was read. ConfigMap channels are watched.")
+	fs.StringVar(&c.SidecarImagePullPolicy, "sidecar-image-pull-policy", "",
+		"ImagePullPolicy of the sidecar, one of Always, IfNotPresent or Never. Defaults to the cluster default.")
+	fs.Var(stringsFlag{&c.SidecarCommand}, "sidecar-command",
+		"Command of the sidecar as a Go template rendered per Deployment, e.g. {{ .Namespace }}. Repeat for every element.")
+	fs.Var(stringsFlag{&c.SidecarArgs}, "sidecar-args",
+		"Args of the sidecar as a Go template rendered per Deployment, e.g. {{ .Name }}. Repeat for every element.")
+	fs.StringVar(&c.SidecarCPURequest, "sidecar-cpu-request", "", "CPU request of the sidecar, e.g. 50m.")
+	fs.StringVar(&c.SidecarMemoryRequest, "sidecar-memory-request", "", "Memory request of the sidecar, e.g. 32Mi.")
+	fs.StringVar(&c.SidecarCPULimit, "sidecar-cpu-limit", "", "CPU limit of the sidecar, e.g. 100m.")
+	fs.StringVar(&c.SidecarMemoryLimit, "sidecar-memory-limit", "", "Memory limit of the sidecar, e.g. 64Mi.")
+	fs.BoolVar(&c.SidecarRequestsOnly, "sidecar-requests-only", false,
+		"Only set the sidecar resource requests and omit its limits, so the pods keep the Burstable QoS class.")
+	fs.Float64Var(&c.SidecarResourceRatio, "sidecar-resource-ratio", 0,
+		"Size the sidecar CPU and memory requests and limits as this fraction of those of the primary container, e.g. 0.25. The sidecar resource flags override it. Disabled when 0.")
+	fs.StringVar(&c.ReplicaScaledResources, "replica-scaled-resources", "",
+		"Size sidecar resource requests by the replica count of the Deployment, as comma separated <resource>=[<base>+]<step>*replicas[:<min>[:<max>]], e.g. memory=64Mi+8Mi*replicas:64Mi:1Gi.")
+	fs.BoolVar(&c.SidecarCritical, "sidecar-critical", true,
+		"Give the sidecar a liveness probe as well as a readiness probe. Non-critical sidecars only get the readiness probe, so a failing sidecar isn't restarted.")
+	fs.BoolVar(&c.SidecarTCPProbe, "sidecar-tcp-probe", false,
+		"Give a sidecar without a readiness probe of its own a TCP readiness probe on its first port.")
+	fs.DurationVar(&c.SidecarPreStopSleep.Duration, "sidecar-prestop-sleep", 0,
+		"Give the sidecar a preStop hook sleeping this long, so it keeps serving while the pod is taken out of rotation. Disabled when 0.")
+	fs.BoolVar(&c.SummaryEvent, "summary-event", false,
+		"Emit a SidecarInjected event with the image, ports and resources of the sidecar, once every time it is injected or its config changed.")
+	fs.BoolVar(&c.CoupleReadiness, "couple-readiness", false,
+		"Only report the sidecar ready once the app wrote the file ready into the shared volume at -couple-readiness-path.")
+	fs.StringVar(&c.CoupleReadinessPath, "couple-readiness-path", "/var/run/node-sidecar",
+		"Where the readiness volume is mounted in the app containers and the sidecar with -couple-readiness.")
+	fs.StringVar(&c.RestartAnnotation, "restart-annotation", "",
+		"Pod template annotation set to the current time whenever an injected sidecar is replaced, e.g. kubectl.kubernetes.io/restartedAt. Disabled when empty.")
+	fs.BoolVar(&c.RemoveOnOptOut, "remove-on-opt-out", false,
+		"Remove the sidecar again from a Deployment that opted out. Deployments whose opt-in can't be read keep it.")
+	fs.BoolVar(&c.RestartOnRemoval, "restart-on-removal", false,
+		"Also set -restart-annotation when the sidecar is removed from a Deployment that opted out, with -remove-on-opt-out.")
+	fs.BoolVar(&c.ReinjectOnDrift, "reinject-on-drift", false,
+		"Re-inject the sidecar when it was edited since it was injected. Fields defaulted by the API server are ignored, so upgrades changing defaults don't trigger re-injection.")
+	fs.Int64Var(&c.SidecarRunAsUser, "sidecar-run-as-user", -1, "UID the sidecar runs as. Defaults to the image's user when -1.")
+	fs.Int64Var(&c.SidecarRunAsGroup, "sidecar-run-as-group", -1, "GID the sidecar runs as. Defaults to the image's group when -1.")
+	fs.Int64Var(&c.SidecarFSGroup, "sidecar-fs-group", -1,
+		"fsGroup set on pods that don't have one, so volumes shared with the sidecar are writable by it. Disabled when -1.")
+	fs.BoolVar(&c.PrewarmSidecar, "prewarm-sidecar", false,
+		"Inject an init container running the sidecar image, so the image is pulled before the app containers start.")
+	fs.Var(stringsFlag{&c.PrewarmCommand}, "prewarm-command",
+		"Command of the prewarm init container. Defaults to /bin/sh -c true. Repeat for every element.")
+
+	fs.BoolVar(&c.LogSidecar, "log-sidecar", false,
+		"Inject a log shipping sidecar that shares an emptyDir with the app containers, or with -primary-container only.")
+	fs.StringVar(&c.LogSidecarPath, "log-sidecar-path", "/var/log/app", "Where the shared log volume is mounted in the app containers and the sidecar.")
+	fs.StringVar(&c.LogSidecarImage, "log-sidecar-image", "fluent/fluent-bit:1.3", "Image of the log shipping sidecar.")
+	fs.Var(stringsFlag{&c.LogSidecarCommand}, "log-sidecar-command",
+		"Command of the log shipping sidecar, templated like -sidecar-command. Defaults to -sidecar-command. Repeat for every element.")
+
+	fs.StringVar(&c.AuditLog, "audit-log", "",
+		"Append every inject, update and skip decision to this file as JSON lines.")
+	fs.Int64Var(&c.AuditLogMaxSize, "audit-log-max-size", 100<<20,
+		"Size in bytes after which the audit log is rotated to <audit-log>.1. 0 disables rotation.")
+}
+
+// loadConfig parses args and layers the result over the -config file, if one
+// is given. The returned config is validated.
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	flags := &Config{}
+	fs.StringVar(&flags.ConfigFile, "config", "", "Path to a YAML file with injector settings. Flags override values from the file.")
+	flags.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg := flags
+	inFile := map[string]interface{}{}
+	if flags.ConfigFile != "" {
+		data, err := ioutil.ReadFile(flags.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		// start from the flag defaults, then the file, then the flags
+		cfg = &Config{}
+		cfg.bindFlags(flag.NewFlagSet("defaults", flag.ContinueOnError))
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", flags.ConfigFile, err)
+		}
+		if err := yaml.Unmarshal(data, &inFile); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", flags.ConfigFile, err)
+		}
+		cfg.ConfigFile = flags.ConfigFile
+		cfg.override(flags, set)
+	}
+
+	cfg.Sources = map[string]string{}
+	cfg.eachSetting(func(name string, _ int) {
+		switch {
+		case set[name]:
+			cfg.Sources[name] = sourceFlag
+		case inFile[name] != nil:
+			cfg.Sources[name] = sourceFile
+		default:
+			cfg.Sources[name] = sourceDefault
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.SidecarConfig != "" && cfg.SidecarConfigMap == "" {
+		// merged with the ConfigMap once the API server can be reached otherwise
+		source, err := readSidecarFile(cfg.SidecarConfig)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.SidecarBase, _, err = loadSidecarBase(source); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// Validate checks the whole config and reports every problem at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.StartRetries < 0 || c.StartRetryBackoff.Duration < 0 {
+		errs = append(errs, fmt.Errorf("start-retries and start-retry-backoff must not be negative"))
+	}
+	if c.LeaderElectionRenewDeadline.Duration <= 0 || c.LeaderElectionRenewDeadline.Duration >= c.LeaderElectionLeaseDuration.Duration {
+		errs = append(errs, fmt.Errorf("leader-election-renew-deadline must be positive and shorter than leader-election-lease-duration"))
+	}
+	if c.EnableExemplars && c.AdminAddr == "" {
+		errs = append(errs, fmt.Errorf("enable-exemplars needs admin-addr"))
+	}
+	if c.ConflictRetrySteps < 1 {
+		errs = append(errs, fmt.Errorf("conflict-retry-steps must be at least 1, got %d", c.ConflictRetrySteps))
+	}
+	if c.ConflictRetryDuration.Duration < 0 || c.ConflictRetryFactor < 0 || c.ConflictRetryJitter < 0 {
+		errs = append(errs, fmt.Errorf("conflict-retry-duration, conflict-retry-factor and conflict-retry-jitter must not be negative"))
+	}
+	if c.ShardCount < 1 {
+		errs = append(errs, fmt.Errorf("shard-count must be at least 1, got %d", c.ShardCount))
+	} else if c.ShardIndex < 0 || c.ShardIndex >= c.ShardCount {
+		errs = append(errs, fmt.Errorf("shard-index must be between 0 and %d, got %d", c.ShardCount-1, c.ShardIndex))
+	}
+	if c.BackfillRate < 0 {
+		errs = append(errs, fmt.Errorf("backfill-rate must not be negative, got %v", c.BackfillRate))
+	}
+	if c.FieldManager == "" {
+		errs = append(errs, fmt.Errorf("field-manager must not be empty"))
+	}
+	if c.PerObjectRate < 0 {
+		errs = append(errs, fmt.Errorf("per-object-rate must not be negative, got %v", c.PerObjectRate))
+	}
+	if c.ReconcileStalenessLimit.Duration < 0 {
+		errs = append(errs, fmt.Errorf("reconcile-staleness-limit must not be negative, got %v", c.ReconcileStalenessLimit.Duration))
+	}
+	if c.PerObjectBurst < 1 {
+		errs = append(errs, fmt.Errorf("per-object-burst must be at least 1, got %d", c.PerObjectBurst))
+	}
+	if c.InstanceID == "" {
+		errs = append(errs, fmt.Errorf("instance-id must not be empty"))
+	}
+	switch c.ForeignInjector {
+	case foreignAdopt, foreignSkip:
+	default:
+		errs = append(errs, fmt.Errorf("foreign-injector must be %s or %s, got %q", foreignAdopt, foreignSkip, c.ForeignInjector))
+	}
+	if c.CountDiscrepancyThreshold < 0 || c.CountDiscrepancyRequeue.Duration < 0 {
+		errs = append(errs, fmt.Errorf("count-discrepancy-threshold and count-discrepancy-requeue must not be negative"))
+	}
+	if sample := fmt.Sprintf(c.PodCountFormat, 0); strings.Contains(sample, "%!") {
+		errs = append(errs, fmt.Errorf("pod-count-format must have a single %%d verb, got %q", c.PodCountFormat))
+	}
+	if c.ImageChannel != "" {
+		if _, err := newImageChannel(c.ImageChannel, c.ImageChannelInterval.Duration); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ActiveRevisionAnnotation != "" {
+		for _, msg := range validation.IsQualifiedName(c.ActiveRevisionAnnotation) {
+			errs = append(errs, fmt.Errorf("invalid active-revision-annotation %q: %s", c.ActiveRevisionAnnotation, msg))
+		}
+	}
+	if c.RestartOnRemoval && (c.RestartAnnotation == "" || !c.RemoveOnOptOut) {
+		errs = append(errs, fmt.Errorf("restart-on-removal needs restart-annotation and remove-on-opt-out"))
+	}
+	if c.CoupleReadiness && !path.IsAbs(c.CoupleReadinessPath) {
+		errs = append(errs, fmt.Errorf("couple-readiness-path must be absolute, got %q", c.CoupleReadinessPath))
+	}
+	if c.SidecarPreStopSleep.Duration < 0 {
+		errs = append(errs, fmt.Errorf("sidecar-prestop-sleep must not be negative, got %v", c.SidecarPreStopSleep.Duration))
+	}
+	if c.RestartAnnotation != "" {
+		for _, msg := range validation.IsQualifiedName(c.RestartAnnotation) {
+			errs = append(errs, fmt.Errorf("invalid restart-annotation %q: %s", c.RestartAnnotation, msg))
+		}
+	}
+	if c.RequireServiceAccount != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(c.RequireServiceAccount) {
+			errs = append(errs, fmt.Errorf("invalid require-service-account %q: %s", c.RequireServiceAccount, msg))
+		}
+	} else if c.SetServiceAccount {
+		errs = append(errs, fmt.Errorf("set-service-account needs require-service-account"))
+	}
+	if c.SidecarRunAsUser < -1 || c.SidecarRunAsGroup < -1 || c.SidecarFSGroup < -1 {
+		errs = append(errs, fmt.Errorf("sidecar-run-as-user, sidecar-run-as-group and sidecar-fs-group must be -1 or an ID"))
+	}
+	if _, err := c.sidecarResources(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseReplicaScaling(c.ReplicaScaledResources); err != nil {
+		errs = append(errs, fmt.Errorf("replica-scaled-resources: %v", err))
+	}
+	if c.SidecarRequestsOnly && c.SidecarCPURequest == "" && c.SidecarMemoryRequest == "" && c.SidecarResourceRatio == 0 {
+		errs = append(errs, fmt.Errorf("sidecar-requests-only needs sidecar-cpu-request, sidecar-memory-request or sidecar-resource-ratio"))
+	}
+	if c.SidecarResourceRatio < 0 {
+		errs = append(errs, fmt.Errorf("sidecar-resource-ratio must not be negative, got %v", c.SidecarResourceRatio))
+	}
+	if c.PrimaryContainer != "" {
+		for _, msg := range validation.IsDNS1123Label(c.PrimaryContainer) {
+			errs = append(errs, fmt.Errorf("invalid primary-container %q: %s", c.PrimaryContainer, msg))
+		}
+		if c.PrimaryContainer == sidecarName {
+			errs = append(errs, fmt.Errorf("primary-container must name an app container, not the sidecar"))
+		}
+	}
+	if c.LogSidecar {
+		if !path.IsAbs(c.LogSidecarPath) {
+			errs = append(errs, fmt.Errorf("log-sidecar-path must be absolute, got %q", c.LogSidecarPath))
+		}
+		if c.LogSidecarImage == "" {
+			errs = append(errs, fmt.Errorf("log-sidecar-image must be set with log-sidecar"))
+		}
+		if c.ImageChannel != "" {
+			errs = append(errs, fmt.Errorf("image-channel can't be combined with log-sidecar"))
+		}
+		if c.SidecarConfig != "" || c.SidecarConfigMap != "" {
+			errs = append(errs, fmt.Errorf("sidecar-config and sidecar-configmap can't be combined with log-sidecar"))
+		}
+	}
+	if c.EnablePolicies {
+		// the policies pick the Deployments and their sidecar
+		conflicts := []struct {
+			name string
+			set  bool
+		}{
+			{"namespace-injection", c.NamespaceInjection},
+			{"sidecar-config", c.SidecarConfig != ""},
+			{"sidecar-configmap", c.SidecarConfigMap != ""},
+			{"image-channel", c.ImageChannel != ""},
+			{"log-sidecar", c.LogSidecar},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				errs = append(errs, fmt.Errorf("%s can't be combined with enable-policies", conflict.name))
+			}
+		}
+	}
+	if (c.SidecarConfig != "" || c.SidecarConfigMap != "") && c.ImageChannel != "" {
+		// the image comes from the container spec
+		errs = append(errs, fmt.Errorf("image-channel can't be combined with sidecar-config or sidecar-configmap"))
+	}
+	if c.SidecarConfigMap != "" {
+		if parts := strings.Split(c.SidecarConfigMap, "/"); len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			errs = append(errs, fmt.Errorf("sidecar-configmap %q must look like <namespace>/<name>/<key>", c.SidecarConfigMap))
+		}
+	}
+	switch c.SidecarSourcePrecedence {
+	case precedenceConfigMap, precedenceFile:
+	default:
+		errs = append(errs, fmt.Errorf("sidecar-source-precedence must be %s or %s, got %q", precedenceConfigMap, precedenceFile, c.SidecarSourcePrecedence))
+	}
+	if c.AuditLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("audit-log-max-size must not be negative, got %d", c.AuditLogMaxSize))
+	}
+	switch core.PullPolicy(c.SidecarImagePullPolicy) {
+	case "", core.PullAlways, core.PullIfNotPresent, core.PullNever:
+	default:
+		errs = append(errs, fmt.Errorf("invalid sidecar-image-pull-policy %q", c.SidecarImagePullPolicy))
+	}
+	var templates []string
+	templates = append(templates, c.SidecarCommand...)
+	templates = append(templates, c.SidecarArgs...)
+	templates = append(templates, c.LogSidecarCommand...)
+	for _, text := range templates {
+		if _, err := template.New("sidecar").Parse(text); err != nil {
+			errs = append(errs, fmt.Errorf("invalid sidecar template %q: %v", text, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// defaultInstanceID returns the name of the Deployment the injector runs in,
+// taken from the pod name from the downward API, falling back to the
+// hostname, which is the pod name as well unless the pod sets its own. Unlike
+// the pod name it survives restarts and rollouts of the injector.
+func defaultInstanceID() string {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return deploymentOfPod(name)
+}
+
+// deploymentOfPod returns the Deployment name of a pod named
+// <deployment>-<pod-template-hash>-<suffix>, or name when it's not named like
+// that, e.g. it isn't run by a Deployment.
+func deploymentOfPod(name string) string {
+	parts := strings.Split(name, "-")
+	if len(parts) < 3 {
+		return name
+	}
+	hash, suffix := parts[len(parts)-2], parts[len(parts)-1]
+	if len(suffix) != 5 || len(hash) < 6 || len(hash) > 10 || !alphanumeric(hash+suffix) {
+		return name
+	}
+	return strings.Join(parts[:len(parts)-2], "-")
+}
+
+// alphanumeric reports whether s only has lowercase letters and digits.
+func alphanumeric(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe returns one "name=value (source)" entry per setting.
+func (c *Config) Describe() []string {
+	var out []string
+	c.eachSetting(func(name string, i int) {
+		value, _ := json.Marshal(c.value(i))
+		out = append(out, fmt.Sprintf("%s=%s (%s)", name, value, c.Sources[name]))
+	})
+	return out
+}
+
+// effectiveSetting is a setting as served on the admin /config route.
+type effectiveSetting struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// Effective returns every setting with its value and where it came from,
+// keyed by flag name.
+func (c *Config) Effective() map[string]effectiveSetting {
+	out := map[string]effectiveSetting{}
+	c.eachSetting(func(name string, i int) {
+		out[name] = effectiveSetting{Value: c.value(i), Source: c.Sources[name]}
+	})
+	return out
+}
+
+// redacted replaces the value of settings tagged redact:"true", which may
+// carry credentials, e.g. a token in the image channel URL.
+const redacted = "<redacted>"
+
+// value returns the value of setting i, or redacted for a sensitive setting
+// that is set.
+func (c *Config) value(i int) interface{} {
+	field := reflect.TypeOf(c).Elem().Field(i)
+	value := reflect.ValueOf(c).Elem().Field(i)
+	if field.Tag.Get("redact") == "true" && !isZero(value) {
+		return redacted
+	}
+	return value.Interface()
+}
+
+// isZero reports whether v is the zero value of its type.
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// override copies every setting named in set from flags into c.
+func (c *Config) override(flags *Config, set map[string]bool) {
+	to, from := reflect.ValueOf(c).Elem(), reflect.ValueOf(flags).Elem()
+	c.eachSetting(func(name string, i int) {
+		if set[name] {
+			to.Field(i).Set(from.Field(i))
+		}
+	})
+}
+
+// eachSetting calls fn with the flag name and field index of every setting.
+func (c *Config) eachSetting(fn func(name string, i int)) {
+	t := reflect.TypeOf(c).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fn(name, i)
+		}
+	}
+}
+
+// stringsFlag is a repeatable flag appending every value to a string slice.
+type stringsFlag struct {
+	values *[]string
+}
+
+func (f stringsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f stringsFlag) Set(value string) error {
+	*f.values = append(*f.values, value)
+	return nil
+}
+
+// conflictBackoff returns the backoff for retrying conflicting updates.
+func (c *Config) conflictBackoff() wait.Backoff {
+	return wait.Backoff{
+		Steps:    c.ConflictRetrySteps,
+		Duration: c.ConflictRetryDuration.Duration,
+		Factor:   c.ConflictRetryFactor,
+		Jitter:   c.ConflictRetryJitter,
+	}
+}
+
+// startBackoff returns the backoff for restarting a failed manager.
+func (c *Config) startBackoff() wait.Backoff {
+	return wait.Backoff{
+		Steps:    c.StartRetries,
+		Duration: c.StartRetryBackoff.Duration,
+		Factor:   2,
+	}
+}
+
+// sidecarResources returns the resources of the sidecar. Limits are left out
+// with SidecarRequestsOnly.
+func (c *Config) sidecarResources() (core.ResourceRequirements, error) {
+	var resources core.ResourceRequirements
+	var errs []error
+	add := func(list *core.ResourceList, name core.ResourceName, flag, value string) {
+		if value == "" {
+			return
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", flag, value, err))
+			return
+		}
+		if *list == nil {
+			*list = core.ResourceList{}
+		}
+		(*list)[name] = quantity
+	}
+	add(&resources.Requests, core.ResourceCPU, "sidecar-cpu-request", c.SidecarCPURequest)
+	add(&resources.Requests, core.ResourceMemory, "sidecar-memory-request", c.SidecarMemoryRequest)
+	if !c.SidecarRequestsOnly {
+		add(&resources.Limits, core.ResourceCPU, "sidecar-cpu-limit", c.SidecarCPULimit)
+		add(&resources.Limits, core.ResourceMemory, "sidecar-memory-limit", c.SidecarMemoryLimit)
+	}
+	return resources, utilerrors.NewAggregate(errs)
+}
+
+// sidecarSecurityContext returns the security context of the sidecar, or nil
+// when neither its user nor its group is set.
+func (c *Config) sidecarSecurityContext() *core.SecurityContext {
+	if c.SidecarRunAsUser < 0 && c.SidecarRunAsGroup < 0 {
+		return nil
+	}
+	ctx := &core.SecurityContext{}
+	if c.SidecarRunAsUser >= 0 {
+		user := c.SidecarRunAsUser
+		ctx.RunAsUser = &user
+	}
+	if c.SidecarRunAsGroup >= 0 {
+		group := c.SidecarRunAsGroup
+		ctx.RunAsGroup = &group
+	}
+	return ctx
+}
@@ -0,0 +1,179 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	data := "metrics-addr: \":9090\"\npod-count-best-effort: true\nconflict-retry-steps: 3\nimage-channel-interval: 30s\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config=" + file, "-conflict-retry-steps=7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MetricsAddr != ":9090" || !cfg.PodCountBestEffort || cfg.ImageChannelInterval.Duration != 30*time.Second {
+		t.Errorf("settings from the file not applied: %+v", cfg)
+	}
+	if cfg.ConflictRetrySteps != 7 {
+		t.Errorf("conflict-retry-steps = %d, want the flag to override the file", cfg.ConflictRetrySteps)
+	}
+	sources := map[string]string{
+		"metrics-addr":         sourceFile,
+		"conflict-retry-steps": sourceFlag,
+		"image-channel":        sourceDefault,
+	}
+	for name, want := range sources {
+		if got := cfg.Sources[name]; got != want {
+			t.Errorf("source of %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("metrics-adr: \":9090\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config=" + file}); err == nil {
+		t.Errorf("misspelled key accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "shard index out of range", args: []string{"-shard-count=2", "-shard-index=2"}, wantErr: "shard-index must be between 0 and 1"},
+		{name: "no conflict retries", args: []string{"-conflict-retry-steps=0"}, wantErr: "conflict-retry-steps must be at least 1"},
+		{name: "bad pod count format", args: []string{"-pod-count-format=pods"}, wantErr: "pod-count-format must have a single %d verb"},
+		{name: "bad image channel", args: []string{"-image-channel=ftp://example.com"}, wantErr: "must be a configmap: source or an http(s) URL"},
+		{name: "restart without annotation", args: []string{"-remove-on-opt-out", "-restart-on-removal"}, wantErr: "restart-on-removal needs"},
+		{
+			name:    "restart without removal",
+			args:    []string{"-restart-on-removal", "-restart-annotation=example.com/restartedAt"},
+			wantErr: "restart-on-removal needs restart-annotation and remove-on-opt-out",
+		},
+		{name: "foreign skip with default instance id", args: []string{"-foreign-injector=skip"}},
+		{name: "foreign skip with instance id", args: []string{"-foreign-injector=skip", "-instance-id=injector-a"}},
+		{name: "unknown foreign injector mode", args: []string{"-foreign-injector=fight"}, wantErr: "foreign-injector must be adopt or skip"},
+		{name: "bad quantity", args: []string{"-sidecar-cpu-request=lots"}, wantErr: "invalid sidecar-cpu-request"},
+		{name: "requests only without requests", args: []string{"-sidecar-requests-only"}, wantErr: "sidecar-requests-only needs"},
+		{name: "requests only with a ratio", args: []string{"-sidecar-requests-only", "-sidecar-resource-ratio=0.25"}},
+		{name: "negative resource ratio", args: []string{"-sidecar-resource-ratio=-1"}, wantErr: "sidecar-resource-ratio must not be negative"},
+		{name: "bad primary container", args: []string{"-primary-container=App_1"}, wantErr: "invalid primary-container"},
+		{name: "sidecar as primary container", args: []string{"-primary-container=" + sidecarName}, wantErr: "primary-container must name an app container"},
+		{name: "relative readiness path", args: []string{"-couple-readiness", "-couple-readiness-path=ready"}, wantErr: "couple-readiness-path must be absolute"},
+		{name: "policies with namespaces", args: []string{"-enable-policies", "-namespace-injection"}, wantErr: "namespace-injection can't be combined with enable-policies"},
+		{name: "relative log path", args: []string{"-log-sidecar", "-log-sidecar-path=logs"}, wantErr: "log-sidecar-path must be absolute"},
+		{name: "bad active revision annotation", args: []string{"-active-revision-annotation=not an annotation"}, wantErr: "invalid active-revision-annotation"},
+		{name: "bad template", args: []string{"-sidecar-args={{ .Name"}, wantErr: "invalid sidecar template"},
+		{name: "bad pull policy", args: []string{"-sidecar-image-pull-policy=Sometimes"}, wantErr: "invalid sidecar-image-pull-policy"},
+		{name: "negative backfill rate", args: []string{"-backfill-rate=-1"}, wantErr: "backfill-rate must not be negative"},
+		{name: "exemplars without admin server", args: []string{"-enable-exemplars"}, wantErr: "enable-exemplars needs admin-addr"},
+		{name: "exemplars", args: []string{"-enable-exemplars", "-admin-addr=:8081"}},
+		{name: "renew deadline past lease", args: []string{"-leader-election-renew-deadline=20s"}, wantErr: "leader-election-renew-deadline must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), tt.args)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("loadConfig() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeploymentOfPod(t *testing.T) {
+	tests := []struct {
+		pod, want string
+	}{
+		{pod: "node-sidecar-injector-7d9f8b6c5d-x2k4z", want: "node-sidecar-injector"},
+		{pod: "injector-5c8f6d7b9-abcde", want: "injector"},
+		{pod: "injector-0", want: "injector-0"},
+		{pod: "injector-x2k4z", want: "injector-x2k4z"},
+		{pod: "my-laptop", want: "my-laptop"},
+		{pod: "injector-Not_A_Hash-x2k4z", want: "injector-Not_A_Hash-x2k4z"},
+	}
+	for _, tt := range tests {
+		if got := deploymentOfPod(tt.pod); got != tt.want {
+			t.Errorf("deploymentOfPod(%q) = %q, want %q", tt.pod, got, tt.want)
+		}
+	}
+}
+
+func TestConflictBackoff(t *testing.T) {
+	cfg := testConfig(t, "-conflict-retry-duration=100ms", "-conflict-retry-factor=1", "-conflict-retry-jitter=0.5")
+	backoff := cfg.conflictBackoff()
+	if backoff.Jitter != 0.5 {
+		t.Fatalf("jitter = %v, want 0.5", backoff.Jitter)
+	}
+	delays := map[time.Duration]bool{}
+	for i := 0; i < 4; i++ {
+		delay := backoff.Step()
+		if delay < 100*time.Millisecond || delay > 150*time.Millisecond {
+			t.Errorf("delay %v, want between 100ms and 150ms", delay)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Errorf("delays %v, want them jittered", delays)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	_, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-conflict-retry-steps=0", "-per-object-burst=0"})
+	if err == nil || !strings.Contains(err.Error(), "conflict-retry-steps") || !strings.Contains(err.Error(), "per-object-burst") {
+		t.Errorf("loadConfig() error = %v, want both problems", err)
+	}
+}
+
+func TestEffectiveRedacts(t *testing.T) {
+	cfg := testConfig(t, "-image-channel=https://token@example.com/tag")
+	if got := cfg.Effective()["image-channel"].Value; got != redacted {
+		t.Errorf("image-channel = %v, want it redacted", got)
+	}
+	if got := cfg.Effective()["metrics-addr"]; got.Value != ":8080" || got.Source != sourceDefault {
+		t.Errorf("metrics-addr = %+v, want the default", got)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	extenstionsv1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// deployment is the view of a Deployment the reconciler works with, so the
+// same logic serves Deployments read from extensions/v1beta1 and from apps/v1,
+// and ReplicaSets with -inject-replicasets.
+type deployment struct {
+	*metav1.ObjectMeta
+	Template *core.PodTemplateSpec
+	// Replicas is the desired replica count, nil when it was left to the
+	// API server default of 1.
+	Replicas *int32
+	// StatusReplicas and ReadyReplicas are the pods the Deployment controller
+	// last counted, and how many of them are ready. UpdatedReplicas and
+	// AvailableReplicas are the ones running the template of
+	// ObservedGeneration, and the ones available. ReplicaSets have no updated
+	// replicas.
+	StatusReplicas, ReadyReplicas      int32
+	UpdatedReplicas, AvailableReplicas int32
+	ObservedGeneration                 int64
+
+	// Object is the Deployment itself, for writing it back.
+	Object runtime.Object
+}
+
+// asDeployment returns the view of obj, or nil if obj is neither a Deployment
+// nor a ReplicaSet.
+func asDeployment(obj runtime.Object) *deployment {
+	switch d := obj.(type) {
+	case *extenstionsv1.Deployment:
+		return &deployment{ObjectMeta: &d.ObjectMeta, Template: &d.Spec.Template, Replicas: d.Spec.Replicas,
+			StatusReplicas: d.Status.Replicas, ReadyReplicas: d.Status.ReadyReplicas,
+			UpdatedReplicas: d.Status.UpdatedReplicas, AvailableReplicas: d.Status.AvailableReplicas,
+			ObservedGeneration: d.Status.ObservedGeneration, Object: d}
+	case *appsv1.Deployment:
+		return &deployment{ObjectMeta: &d.ObjectMeta, Template: &d.Spec.Template, Replicas: d.Spec.Replicas,
+			StatusReplicas: d.Status.Replicas, ReadyReplicas: d.Status.ReadyReplicas,
+			UpdatedReplicas: d.Status.UpdatedReplicas, AvailableReplicas: d.Status.AvailableReplicas,
+			ObservedGeneration: d.Status.ObservedGeneration, Object: d}
+	case *appsv1.ReplicaSet:
+		return &deployment{ObjectMeta: &d.ObjectMeta, Template: &d.Spec.Template, Replicas: d.Spec.Replicas,
+			StatusReplicas: d.Status.Replicas, ReadyReplicas: d.Status.ReadyReplicas,
+			AvailableReplicas: d.Status.AvailableReplicas, ObservedGeneration: d.Status.ObservedGeneration, Object: d}
+	}
+	return nil
+}
+
+// newDeployment returns an empty Deployment of the API group the injector
+// watches. On clusters serving Deployments from both groups only apps/v1 is
+// watched with preferAppsV1, so every Deployment is reconciled once.
+func newDeployment(preferAppsV1 bool) runtime.Object {
+	if preferAppsV1 {
+		return &appsv1.Deployment{}
+	}
+	return &extenstionsv1.Deployment{}
+}
+
+// listDeployments lists the Deployments of the watched API group.
+func listDeployments(c client.Reader, preferAppsV1 bool, opts ...client.ListOption) ([]*deployment, error) {
+	var deps []*deployment
+	if preferAppsV1 {
+		list := &appsv1.DeploymentList{}
+		if err := c.List(context.TODO(), list, opts...); err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			deps = append(deps, asDeployment(&list.Items[i]))
+		}
+		return deps, nil
+	}
+	list := &extenstionsv1.DeploymentList{}
+	if err := c.List(context.TODO(), list, opts...); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		deps = append(deps, asDeployment(&list.Items[i]))
+	}
+	return deps, nil
+}
+
+// listReplicaSets lists the ReplicaSets that aren't controlled by a
+// Deployment.
+func listReplicaSets(c client.Reader, opts ...client.ListOption) ([]*deployment, error) {
+	list := &appsv1.ReplicaSetList{}
+	if err := c.List(context.TODO(), list, opts...); err != nil {
+		return nil, err
+	}
+	var sets []*deployment
+	for i := range list.Items {
+		if standalone(&list.Items[i]) {
+			sets = append(sets, asDeployment(&list.Items[i]))
+		}
+	}
+	return sets, nil
+}
+
+// listInjectable lists the Deployments of the watched API group, and the
+// standalone ReplicaSets with -inject-replicasets.
+func (a *MyReconciler) listInjectable(opts ...client.ListOption) ([]*deployment, error) {
+	deps, err := listDeployments(a, a.Config.PreferAppsV1, opts...)
+	if err != nil || !a.Config.InjectReplicaSets {
+		return deps, err
+	}
+	sets, err := listReplicaSets(a, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return append(deps, sets...), nil
+}
+
+// enqueueInjected sends every Deployment, or ReplicaSet, that opted into the
+// sidecar to its controller.
+func (a *MyReconciler) enqueueInjected() error {
+	var opts []client.ListOption
+	if !a.Config.NamespaceInjection && !a.Config.EnablePolicies {
+		// only Deployments can opt in, let the API server filter them
+		opts = append(opts, client.MatchingLabels{"node-sidecar": "true"})
+	}
+	deps, err := a.listInjectable(opts...)
+	if err != nil {
+		return err
+	}
+	var selected []*deployment
+	for _, dep := range deps {
+		if opted, _ := a.optedIn(dep); opted {
+			selected = append(selected, dep)
+		}
+	}
+	a.enqueue(selected)
+	return nil
+}
+
+// enqueueNamespace sends every Deployment, or ReplicaSet, of namespace that
+// follows the namespace's injection label to its controller.
+func (a *MyReconciler) enqueueNamespace(namespace string) error {
+	deps, err := a.listInjectable(client.InNamespace(namespace))
+	if err != nil {
+		return err
+	}
+	var selected []*deployment
+	for _, dep := range deps {
+		if _, own := dep.Labels["node-sidecar"]; !own {
+			selected = append(selected, dep)
+		}
+	}
+	a.enqueue(selected)
+	return nil
+}
+
+// enqueue sends deps to their controller, paced by Backfill so a large fleet
+// doesn't hit the API server all at once.
+func (a *MyReconciler) enqueue(deps []*deployment) {
+	for _, dep := range deps {
+		if dep.Name == "" {
+			continue
+		}
+		if a.Backfill != nil {
+			// only fails for a burst below one
+			_ = a.Backfill.Wait(context.TODO())
+		}
+		events := a.Events
+		if _, rs := dep.Object.(*appsv1.ReplicaSet); rs {
+			events = a.ReplicaSetEvents
+		}
+		events <- event.GenericEvent{Meta: dep.ObjectMeta, Object: dep.Object}
+	}
+}
+
+// newBackfillLimiter returns the limiter pacing enqueues to perSecond
+// Deployments per second, letting everything through when perSecond is 0.
+func newBackfillLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
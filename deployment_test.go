@@ -0,0 +1,165 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	extenstionsv1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// enqueued drains the names of the Deployments sent through events.
+func enqueued(events chan event.GenericEvent) []string {
+	var names []string
+	for len(events) > 0 {
+		names = append(names, (<-events).Meta.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEnqueueInjected(t *testing.T) {
+	opted := map[string]string{"node-sidecar": "true"}
+	optedOut := map[string]string{"node-sidecar": "false"}
+	namespace := &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: opted}}
+	objs := []runtime.Object{
+		namespace,
+		testDeployment("opted-in", opted),
+		testDeployment("opted-out", optedOut),
+		testDeployment("unlabelled", nil),
+	}
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "deployment labels", want: []string{"opted-in"}},
+		{name: "namespace injection", args: []string{"-namespace-injection"}, want: []string{"opted-in", "unlabelled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(chan event.GenericEvent, len(objs))
+			a := testReconciler(testConfig(t, tt.args...), objs...)
+			a.Events = events
+			if err := a.enqueueInjected(); err != nil {
+				t.Fatal(err)
+			}
+			if got := enqueued(events); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("enqueued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnqueueNamespace(t *testing.T) {
+	events := make(chan event.GenericEvent, 3)
+	a := testReconciler(testConfig(t, "-namespace-injection"),
+		testDeployment("follows", nil),
+		testDeployment("own-label", map[string]string{"node-sidecar": "true"}),
+	)
+	a.Events = events
+	if err := a.enqueueNamespace("default"); err != nil {
+		t.Fatal(err)
+	}
+	if got := enqueued(events); fmt.Sprint(got) != "[follows]" {
+		t.Errorf("enqueued %v, want only the Deployment following the namespace", got)
+	}
+}
+
+func TestEnqueueBackfill(t *testing.T) {
+	tests := []struct {
+		perSecond   float64
+		wantAtLeast time.Duration
+	}{
+		{perSecond: 0},
+		{perSecond: 20, wantAtLeast: 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.perSecond), func(t *testing.T) {
+			events := make(chan event.GenericEvent, 3)
+			a := testReconciler(testConfig(t))
+			a.Events = events
+			a.Backfill = newBackfillLimiter(tt.perSecond)
+			deps := []*deployment{
+				asDeployment(testDeployment("a", nil)),
+				asDeployment(testDeployment("b", nil)),
+				asDeployment(testDeployment("c", nil)),
+			}
+			start := time.Now()
+			a.enqueue(deps)
+			if took := time.Since(start); took < tt.wantAtLeast {
+				t.Errorf("enqueued 3 Deployments in %v, want at least %v", took, tt.wantAtLeast)
+			}
+			if got := enqueued(events); len(got) != 3 {
+				t.Errorf("enqueued %v, want all 3", got)
+			}
+		})
+	}
+}
+
+// appsDeployment returns the apps/v1 copy of the Deployment obj, as served to
+// clients of that group.
+func appsDeployment(obj *extenstionsv1.Deployment) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
+		Spec:       appsv1.DeploymentSpec{Template: *obj.Spec.Template.DeepCopy()},
+	}
+}
+
+func TestPreferAppsV1(t *testing.T) {
+	// the same Deployment served from both groups mid-migration
+	legacy := testDeployment("web", map[string]string{"node-sidecar": "true"})
+	events := make(chan event.GenericEvent, 10)
+	a := testReconciler(testConfig(t, "-prefer-apps-v1"), legacy, appsDeployment(legacy))
+	a.Events = events
+	if err := a.enqueueInjected(); err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	for len(events) > 0 {
+		e := <-events
+		if _, apps := e.Object.(*appsv1.Deployment); !apps {
+			t.Errorf("enqueued a %T, want apps/v1 only", e.Object)
+		}
+		requests++
+		if _, err := a.Reconcile(request(e.Meta.GetName())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("deployment enqueued %d times, want once", requests)
+	}
+
+	apps := &appsv1.Deployment{}
+	if err := a.Get(context.TODO(), request("web").NamespacedName, apps); err != nil {
+		t.Fatal(err)
+	}
+	if sidecarIndex(&apps.Spec.Template.Spec) < 0 {
+		t.Errorf("apps/v1 deployment not injected")
+	}
+	if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) >= 0 {
+		t.Errorf("extensions/v1beta1 deployment written as well")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	core "k8s.io/api/core/v1"
+)
+
+// drifted reports whether the live sidecar no longer matches the desired one.
+// Only the fields desired sets are compared: the API server fills in defaults
+// for the others, and a cluster upgrade may add new ones, neither of which is
+// a change worth re-injecting for.
+func drifted(live, desired core.Container) bool {
+	// the shared volumes are mounted into the sidecar after it was built
+	mounts := live.VolumeMounts
+	live.VolumeMounts = nil
+	for _, m := range mounts {
+		if (m.Name != logVolumeName && m.Name != readinessVolumeName) || mounted(&desired, m.Name) {
+			live.VolumeMounts = append(live.VolumeMounts, m)
+		}
+	}
+	want, err := asJSON(desired)
+	if err != nil {
+		return false
+	}
+	got, err := asJSON(live)
+	if err != nil {
+		return false
+	}
+	return !subset(want, got)
+}
+
+// mounted reports whether container mounts the volume name.
+func mounted(container *core.Container, name string) bool {
+	for _, m := range container.VolumeMounts {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// asJSON returns container the way it is stored, so quantities and other
+// values with several spellings compare in their canonical form.
+func asJSON(container core.Container) (interface{}, error) {
+	data, err := json.Marshal(container)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
+// subset reports whether every value set in want is the same in got. Lists
+// must have the same length, their elements are compared pairwise.
+func subset(want, got interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return len(w) == 0 && got == nil
+		}
+		for key, value := range w {
+			if !subset(value, g[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return len(w) == 0 && got == nil
+		}
+		for i := range w {
+			if !subset(w[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	case nil:
+		return true
+	}
+	if reflect.DeepEqual(want, reflect.Zero(reflect.TypeOf(want)).Interface()) {
+		// a zero value that isn't omitted is as good as unset
+		return true
+	}
+	return reflect.DeepEqual(want, got)
+}
@@ -0,0 +1,129 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestDrifted(t *testing.T) {
+	desired := sideCarContainer("node-demo:1")
+	desired.Resources.Requests = core.ResourceList{core.ResourceMemory: resource.MustParse("64Mi")}
+	desired.ReadinessProbe = &core.Probe{Handler: core.Handler{TCPSocket: &core.TCPSocketAction{Port: intstr.FromInt(sidecarPort)}}}
+
+	tests := []struct {
+		name string
+		edit func(live *core.Container)
+		want bool
+	}{
+		{name: "unchanged", edit: func(*core.Container) {}, want: false},
+		{
+			name: "defaulted by the api server",
+			edit: func(live *core.Container) {
+				live.TerminationMessagePath = core.TerminationMessagePathDefault
+				live.TerminationMessagePolicy = core.TerminationMessageReadFile
+				live.ImagePullPolicy = core.PullIfNotPresent
+				live.ReadinessProbe.TimeoutSeconds = 1
+				live.ReadinessProbe.PeriodSeconds = 10
+				live.ReadinessProbe.SuccessThreshold = 1
+				live.ReadinessProbe.FailureThreshold = 3
+			},
+			want: false,
+		},
+		{
+			name: "quantity spelled differently",
+			edit: func(live *core.Container) {
+				live.Resources.Requests = core.ResourceList{core.ResourceMemory: resource.MustParse("65536Ki")}
+			},
+			want: false,
+		},
+		{
+			name: "shared volume mounted",
+			edit: func(live *core.Container) {
+				live.VolumeMounts = []core.VolumeMount{{Name: logVolumeName, MountPath: "/var/log/app"}}
+			},
+			want: false,
+		},
+		{name: "image edited", edit: func(live *core.Container) { live.Image = "node-demo:2" }, want: true},
+		{name: "port removed", edit: func(live *core.Container) { live.Ports = nil }, want: true},
+		{name: "probe removed", edit: func(live *core.Container) { live.ReadinessProbe = nil }, want: true},
+		{
+			name: "other volume mounted",
+			edit: func(live *core.Container) {
+				live.VolumeMounts = []core.VolumeMount{{Name: "data", MountPath: "/data"}}
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := *desired.DeepCopy()
+			tt.edit(&live)
+			if got := drifted(live, desired); got != tt.want {
+				t.Errorf("drifted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileReinjectsOnDrift(t *testing.T) {
+	a := testReconciler(testConfig(t, "-reinject-on-drift", "-sidecar-cpu-request=50m"),
+		testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	// filled in by the API server
+	live := stored(t, a.Client, "web")
+	sidecar := &live.Template.Spec.Containers[sidecarIndex(&live.Template.Spec)]
+	want := sidecar.Image
+	sidecar.TerminationMessagePath = core.TerminationMessagePathDefault
+	sidecar.TerminationMessagePolicy = core.TerminationMessageReadFile
+	if sidecar.ImagePullPolicy == "" {
+		sidecar.ImagePullPolicy = core.PullIfNotPresent
+	}
+	sidecar.Resources.Requests[core.ResourceCPU] = resource.MustParse("0.05")
+	if err := a.Update(context.TODO(), live.Object); err != nil {
+		t.Fatal(err)
+	}
+	c := &failingClient{Client: a.Client, fail: func(int, runtime.Object) error { return nil }}
+	a.Client = c
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if c.updates != 0 {
+		t.Errorf("defaulted sidecar re-injected with %d updates", c.updates)
+	}
+
+	// edited by hand
+	live = stored(t, a.Client, "web")
+	live.Template.Spec.Containers[sidecarIndex(&live.Template.Spec)].Image = "node-demo:debug"
+	if err := a.Update(context.TODO(), live.Object); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	live = stored(t, a.Client, "web")
+	if got := live.Template.Spec.Containers[sidecarIndex(&live.Template.Spec)].Image; got != want {
+		t.Errorf("drifted image = %q, want it re-injected as %q", got, want)
+	}
+}
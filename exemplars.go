@@ -0,0 +1,109 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// maxExemplarRunes is the most an exemplar's label names and values may add
+// up to in OpenMetrics.
+const maxExemplarRunes = 128
+
+// histogramExemplars keeps the latest exemplar of every bucket of a
+// histogram, the Deployment whose observation went into it, and serves the
+// histogram with them in the OpenMetrics text format. The Prometheus client
+// the injector builds with predates exemplars, so they can't be served on
+// -metrics-addr.
+//
+// A nil *histogramExemplars records nothing.
+type histogramExemplars struct {
+	histogram prometheus.Histogram
+	opts      prometheus.HistogramOpts
+
+	mu sync.Mutex
+	// exemplars is keyed by bucket index, len(opts.Buckets) for +Inf
+	exemplars map[int]exemplar
+}
+
+type exemplar struct {
+	key   types.NamespacedName
+	value float64
+	at    time.Time
+}
+
+func newHistogramExemplars(histogram prometheus.Histogram, opts prometheus.HistogramOpts) *histogramExemplars {
+	return &histogramExemplars{histogram: histogram, opts: opts, exemplars: map[int]exemplar{}}
+}
+
+// record keeps value observed for key as the exemplar of its bucket.
+func (e *histogramExemplars) record(key types.NamespacedName, value float64) {
+	if e == nil {
+		return
+	}
+	if utf8.RuneCountInString("namespace"+key.Namespace+"name"+key.Name) > maxExemplarRunes {
+		// it would be rejected as a whole
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exemplars[sort.SearchFloat64s(e.opts.Buckets, value)] = exemplar{key: key, value: value, at: time.Now()}
+}
+
+// ServeHTTP writes the histogram and its exemplars in the OpenMetrics text
+// format.
+func (e *histogramExemplars) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := &dto.Metric{}
+	if err := e.histogram.Write(m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	name := e.opts.Name
+	fmt.Fprintf(w, "# TYPE %s histogram\n# HELP %s %s\n", name, name, e.opts.Help)
+	for i, bucket := range m.GetHistogram().GetBucket() {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d%s\n", name, formatFloat(bucket.GetUpperBound()), bucket.GetCumulativeCount(), e.exemplarAt(i))
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d%s\n", name, m.GetHistogram().GetSampleCount(), e.exemplarAt(len(e.opts.Buckets)))
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n# EOF\n", name, formatFloat(m.GetHistogram().GetSampleSum()), name, m.GetHistogram().GetSampleCount())
+}
+
+// exemplarAt returns the exemplar of bucket i as appended to its sample, or ""
+// if it has none.
+func (e *histogramExemplars) exemplarAt(i int) string {
+	ex, found := e.exemplars[i]
+	if !found {
+		return ""
+	}
+	at := float64(ex.at.UnixNano()) / float64(time.Second)
+	return fmt.Sprintf(" # {namespace=%q,name=%q} %s %s", ex.key.Namespace, ex.key.Name, formatFloat(ex.value), formatFloat(at))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,70 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRolloutExemplars(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      bool
+		wantExemplar bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", enabled: true, wantExemplar: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served := newHistogramExemplars(rolloutDuration, rolloutDurationOpts)
+			var exemplars *histogramExemplars
+			if tt.enabled {
+				exemplars = served
+			}
+			obj := testDeployment("web", nil)
+			obj.Spec.Template.Spec.Containers = append(obj.Spec.Template.Spec.Containers, core.Container{Name: sidecarName})
+			obj.Status.ObservedGeneration, obj.Status.UpdatedReplicas, obj.Status.Replicas, obj.Status.AvailableReplicas = 2, 1, 1, 1
+			key := types.NamespacedName{Namespace: "default", Name: "web"}
+			tracker := newRolloutTracker(exemplars)
+			tracker.start(key, 2)
+			tracker.observe(key, asDeployment(obj))
+
+			w := httptest.NewRecorder()
+			served.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/exemplars", nil))
+			body := w.Body.String()
+			// rolled out right away, in the first bucket
+			first := rolloutDurationOpts.Name + "_bucket{le=\"5\"} "
+			var line string
+			for _, l := range strings.Split(body, "\n") {
+				if strings.HasPrefix(l, first) {
+					line = l
+				}
+			}
+			if line == "" || !strings.HasSuffix(body, "# EOF\n") {
+				t.Fatalf("served %q, want the histogram in OpenMetrics", body)
+			}
+			if got := strings.Contains(line, `# {namespace="default",name="web"} `); got != tt.wantExemplar {
+				t.Errorf("first bucket %q has an exemplar = %v, want %v", line, got, tt.wantExemplar)
+			}
+		})
+	}
+}
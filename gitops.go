@@ -0,0 +1,171 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// gitOpsIgnoreAnnotation marks a Deployment changed by the injector, so GitOps
+// tools can be told to ignore the difference to the manifests they apply.
+const gitOpsIgnoreAnnotation = "node-sidecar/gitops-ignore"
+
+// setGitOpsIgnore sets obj's gitops-ignore annotation. It reports whether the
+// annotations changed.
+func setGitOpsIgnore(obj metav1.Object) bool {
+	annotations := obj.GetAnnotations()
+	if annotations[gitOpsIgnoreAnnotation] == "true" {
+		return false
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[gitOpsIgnoreAnnotation] = "true"
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// write stores obj, with an update by default or with a server-side apply of
+// the fields the injector owns with -server-side-apply. Either way the change
+// is recorded under -field-manager.
+func (a *MyReconciler) write(obj runtime.Object) error {
+	owner := client.FieldOwner(a.Config.FieldManager)
+	if !a.Config.ServerSideApply {
+		return a.Update(context.TODO(), obj, owner)
+	}
+	applied, err := a.owned(obj)
+	if err != nil {
+		return err
+	}
+	// fields applied before with plain updates are taken over
+	if err := a.Patch(context.TODO(), applied, client.Apply, owner, client.ForceOwnership); err != nil {
+		return err
+	}
+	// carry on from what the API server stored, like an update does
+	meta := asDeployment(obj)
+	meta.SetResourceVersion(applied.GetResourceVersion())
+	meta.SetGeneration(applied.GetGeneration())
+	return nil
+}
+
+// owned returns the apply configuration of obj: only the fields the injector
+// sets, so a field it stops sending is removed and every other field is left
+// to its owner.
+func (a *MyReconciler) owned(obj runtime.Object) (*unstructured.Unstructured, error) {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return nil, err
+	}
+	dep := asDeployment(obj)
+	spec := &dep.Template.Spec
+
+	applied := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	applied.SetGroupVersionKind(gvk)
+	applied.SetNamespace(dep.Namespace)
+	applied.SetName(dep.Name)
+	applied.SetLabels(pick(dep.Labels, "pod-count"))
+	applied.SetAnnotations(pick(dep.Annotations, "pod-count", sidecarHashAnnotation, injectedByAnnotation, skipReasonAnnotation, gitOpsIgnoreAnnotation))
+
+	template := map[string]interface{}{}
+	if annotations := pick(dep.Template.Annotations, a.Config.RestartAnnotation); len(annotations) > 0 {
+		template["metadata"] = map[string]interface{}{"annotations": toInterfaces(annotations)}
+	}
+	pod := map[string]interface{}{}
+	var containers, initContainers, volumes []interface{}
+	shared := map[string]bool{logVolumeName: true, readinessVolumeName: true}
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name == sidecarName {
+			c, err := runtime.DefaultUnstructuredConverter.ToUnstructured(container)
+			if err != nil {
+				return nil, err
+			}
+			containers = append(containers, c)
+			continue
+		}
+		var mounts []interface{}
+		for _, m := range container.VolumeMounts {
+			if shared[m.Name] {
+				mounts = append(mounts, map[string]interface{}{"name": m.Name, "mountPath": m.MountPath})
+			}
+		}
+		if len(mounts) > 0 {
+			containers = append(containers, map[string]interface{}{"name": container.Name, "volumeMounts": mounts})
+		}
+	}
+	for i := range spec.InitContainers {
+		if spec.InitContainers[i].Name != prewarmName {
+			continue
+		}
+		c, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&spec.InitContainers[i])
+		if err != nil {
+			return nil, err
+		}
+		initContainers = append(initContainers, c)
+	}
+	for _, v := range spec.Volumes {
+		if shared[v.Name] {
+			volumes = append(volumes, map[string]interface{}{"name": v.Name, "emptyDir": map[string]interface{}{}})
+		}
+	}
+	for name, list := range map[string][]interface{}{"containers": containers, "initContainers": initContainers, "volumes": volumes} {
+		if len(list) > 0 {
+			pod[name] = list
+		}
+	}
+	if a.Config.SetServiceAccount && spec.ServiceAccountName == a.Config.RequireServiceAccount {
+		pod["serviceAccountName"] = spec.ServiceAccountName
+	}
+	if ctx := spec.SecurityContext; a.Config.SidecarFSGroup >= 0 && ctx != nil && ctx.FSGroup != nil && *ctx.FSGroup == a.Config.SidecarFSGroup {
+		pod["securityContext"] = map[string]interface{}{"fsGroup": *ctx.FSGroup}
+	}
+	if len(pod) > 0 {
+		template["spec"] = pod
+	}
+	if len(template) > 0 {
+		applied.Object["spec"] = map[string]interface{}{"template": template}
+	}
+	return applied, nil
+}
+
+// pick returns the entries of m under keys, or nil if there are none.
+func pick(m map[string]string, keys ...string) map[string]string {
+	var picked map[string]string
+	for _, key := range keys {
+		if value, found := m[key]; found && key != "" {
+			if picked == nil {
+				picked = map[string]string{}
+			}
+			picked[key] = value
+		}
+	}
+	return picked
+}
+
+// toInterfaces converts m for an unstructured object.
+func toInterfaces(m map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		out[key] = value
+	}
+	return out
+}
@@ -0,0 +1,133 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// applyRecorder records the patches sent through it instead of sending them,
+// as the fake client can't apply.
+type applyRecorder struct {
+	client.Client
+	patches []recordedPatch
+}
+
+type recordedPatch struct {
+	obj  *unstructured.Unstructured
+	typ  types.PatchType
+	opts *client.PatchOptions
+}
+
+func (c *applyRecorder) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.patches = append(c.patches, recordedPatch{
+		obj:  obj.(*unstructured.Unstructured).DeepCopy(),
+		typ:  patch.Type(),
+		opts: (&client.PatchOptions{}).ApplyOptions(opts),
+	})
+	return nil
+}
+
+// appliedContainers returns the names of the containers in the pod template
+// of applied.
+func appliedContainers(t *testing.T, applied *unstructured.Unstructured) []string {
+	t.Helper()
+	containers, _, err := unstructured.NestedSlice(applied.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range containers {
+		names = append(names, c.(map[string]interface{})["name"].(string))
+	}
+	return names
+}
+
+func TestWriteServerSideApply(t *testing.T) {
+	a := testReconciler(testConfig(t, "-server-side-apply", "-field-manager=mesh-injector", "-gitops-ignore"),
+		testDeployment("web", map[string]string{"node-sidecar": "true"}), testPod("web-1", "web"))
+	c := &applyRecorder{Client: a.Client}
+	a.Client = c
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.patches) == 0 {
+		t.Fatalf("nothing applied")
+	}
+	p := c.patches[0]
+	if p.typ != types.ApplyPatchType {
+		t.Errorf("patch type = %q, want %q", p.typ, types.ApplyPatchType)
+	}
+	if p.opts.FieldManager != "mesh-injector" {
+		t.Errorf("field manager = %q, want mesh-injector", p.opts.FieldManager)
+	}
+	if p.opts.Force == nil || !*p.opts.Force {
+		t.Errorf("ownership not forced")
+	}
+	if got := p.obj.GetAnnotations()[gitOpsIgnoreAnnotation]; got != "true" {
+		t.Errorf("%s = %q, want true", gitOpsIgnoreAnnotation, got)
+	}
+	if got := appliedContainers(t, p.obj); !equalStrings(got, []string{sidecarName}) {
+		t.Errorf("applied containers = %q, want only the sidecar", got)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(p.obj.Object, "spec", "replicas"); found {
+		t.Errorf("applied fields the injector doesn't own: %v", p.obj.Object["spec"])
+	}
+}
+
+func TestWriteServerSideApplyRemoves(t *testing.T) {
+	a := testReconciler(testConfig(t, "-remove-on-opt-out", "-log-sidecar"),
+		testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	live := stored(t, a.Client, "web")
+	if sidecarIndex(&live.Template.Spec) < 0 || len(live.Template.Spec.Volumes) == 0 {
+		t.Fatalf("sidecar and log volume not injected: %+v", live.Template.Spec)
+	}
+	live.Labels["node-sidecar"] = "false"
+	if err := a.Update(context.TODO(), live.Object); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Config.ServerSideApply = true
+	c := &applyRecorder{Client: a.Client}
+	a.Client = c
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.patches) == 0 {
+		t.Fatalf("removal not applied")
+	}
+	applied := c.patches[0].obj
+	// left out of the apply, so dropped from what the injector owns, while
+	// the app container belongs to its owner either way
+	if got := appliedContainers(t, applied); len(got) != 0 {
+		t.Errorf("applied containers = %q, want none", got)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(applied.Object, "spec", "template", "spec", "volumes"); found {
+		t.Errorf("log volume still applied")
+	}
+	if got := applied.GetName(); got != "web" {
+		t.Errorf("applied name = %q, want web", got)
+	}
+}
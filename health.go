@@ -0,0 +1,126 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var injectionDisabled = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "node_sidecar_injection_disabled",
+	Help: "1 while injection is disabled because reconciles stopped succeeding, 0 otherwise.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(injectionDisabled)
+}
+
+// recoveryProbes is how many reads from the API server in a row have to
+// succeed before a tripped reconcileHealth enables injection again.
+const recoveryProbes = 3
+
+// reconcileHealth is a dead man's switch: once reconciles kept failing without
+// a single success for longer than limit it trips, and the reconciler stops changing Deployments
+// from a cache that may be stale until recoveryProbes probes of the API server
+// in a row succeeded. A limit of 0 never trips.
+type reconcileHealth struct {
+	limit time.Duration
+	log   logr.Logger
+
+	mu sync.Mutex
+	// failingSince is the first failure since the last success, zero while
+	// reconciles succeed
+	failingSince time.Time
+	tripped      bool
+	// probes is the number of successful probes in a row while tripped
+	probes int
+}
+
+func newReconcileHealth(limit time.Duration, log logr.Logger) *reconcileHealth {
+	injectionDisabled.Set(0)
+	return &reconcileHealth{limit: limit, log: log}
+}
+
+// observe records the outcome of a reconcile. While tripped a reconcile
+// only probes, so its success doesn't count, see probe.
+func (h *reconcileHealth) observe(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		// an idle injector has no successes either, only failures count
+		if h.failingSince.IsZero() {
+			h.failingSince = time.Now()
+		}
+		h.probes = 0
+		h.check()
+		return
+	}
+	if !h.tripped {
+		h.failingSince = time.Time{}
+	}
+}
+
+// probe records the outcome of a read from the API server while tripped. A
+// single read may just have been lucky, injection is only enabled again once
+// recoveryProbes of them in a row succeeded.
+func (h *reconcileHealth) probe(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.probes = 0
+		return
+	}
+	if !h.tripped {
+		return
+	}
+	if h.probes++; h.probes < recoveryProbes {
+		return
+	}
+	h.log.Info("the API server answers again, enabling injection", "probes", h.probes)
+	injectionDisabled.Set(0)
+	h.failingSince, h.tripped, h.probes = time.Time{}, false, 0
+}
+
+// Tripped reports whether injection is disabled.
+func (h *reconcileHealth) Tripped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.check()
+	return h.tripped
+}
+
+// Ready returns an error while injection is disabled. It serves /readyz.
+func (h *reconcileHealth) Ready() error {
+	if h.Tripped() {
+		return fmt.Errorf("no reconcile succeeded for more than %v, injection is disabled", h.limit)
+	}
+	return nil
+}
+
+func (h *reconcileHealth) check() {
+	if h.tripped || h.failingSince.IsZero() || h.limit == 0 || time.Since(h.failingSince) <= h.limit {
+		return
+	}
+	h.tripped = true
+	h.log.Info("no reconcile succeeded in time, disabling injection", "limit", h.limit, "failingSince", h.failingSince)
+	injectionDisabled.Set(1)
+}
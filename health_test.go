@@ -0,0 +1,64 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestReconcileHealth(t *testing.T) {
+	failure := errors.New("api server down")
+	tests := []struct {
+		name        string
+		limit       time.Duration
+		outcomes    []error
+		probes      []error
+		wantTripped bool
+	}{
+		{name: "never trips without a limit", outcomes: []error{failure, failure}},
+		{name: "idle", limit: time.Nanosecond},
+		{name: "failing past the limit", limit: time.Nanosecond, outcomes: []error{failure}, wantTripped: true},
+		{name: "failing within the limit", limit: time.Hour, outcomes: []error{failure, failure}},
+		{name: "succeeds within the limit", limit: time.Hour, outcomes: []error{failure, nil}},
+		{name: "tripped reconcile succeeds", limit: time.Nanosecond, outcomes: []error{failure, nil}, wantTripped: true},
+		{name: "one probe succeeds", limit: time.Nanosecond, outcomes: []error{failure}, probes: []error{nil}, wantTripped: true},
+		{name: "probes succeed", limit: time.Nanosecond, outcomes: []error{failure}, probes: []error{nil, nil, nil}},
+		{name: "probe fails in between", limit: time.Nanosecond, outcomes: []error{failure}, probes: []error{nil, nil, failure, nil, nil}, wantTripped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newReconcileHealth(tt.limit, ctrl.Log.WithName("test"))
+			for _, err := range tt.outcomes {
+				h.observe(err)
+			}
+			time.Sleep(time.Millisecond)
+			h.Tripped()
+			for _, err := range tt.probes {
+				h.probe(err)
+			}
+			if got := h.Tripped(); got != tt.wantTripped {
+				t.Errorf("Tripped() = %v, want %v", got, tt.wantTripped)
+			}
+			if got := h.Ready() != nil; got != tt.wantTripped {
+				t.Errorf("Ready() failed = %v, want %v", got, tt.wantTripped)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	core "k8s.io/api/core/v1"
+)
+
+// logVolumeName is the emptyDir shared by the app containers and the sidecar
+// in log sidecar mode.
+const logVolumeName = "node-sidecar-logs"
+
+// injectLogVolume wires the shared log volume into spec. It reports whether
+// spec changed.
+func injectLogVolume(spec *core.PodSpec, path, primary string) bool {
+	return injectSharedVolume(spec, logVolumeName, path, primary)
+}
+
+// injectSharedVolume wires the emptyDir name into spec: the volume itself and
+// a mount at path in the sidecar and in the app containers, which are the
+// primary container when one is named or all of them otherwise. It reports
+// whether spec changed.
+func injectSharedVolume(spec *core.PodSpec, name, path, primary string) bool {
+	changed := ensureVolume(spec, core.Volume{
+		Name:         name,
+		VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}},
+	})
+	mount := core.VolumeMount{Name: name, MountPath: path}
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name != sidecarName && primary != "" && container.Name != primary {
+			continue
+		}
+		if ensureVolumeMount(container, mount) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// ensureVolume adds volume to spec unless a volume of that name exists.
+func ensureVolume(spec *core.PodSpec, volume core.Volume) bool {
+	for _, v := range spec.Volumes {
+		if v.Name == volume.Name {
+			return false
+		}
+	}
+	spec.Volumes = append(spec.Volumes, volume)
+	return true
+}
+
+// ensureVolumeMount adds mount to container unless the volume is already
+// mounted in it.
+func ensureVolumeMount(container *core.Container, mount core.VolumeMount) bool {
+	for _, m := range container.VolumeMounts {
+		if m.Name == mount.Name {
+			return false
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, mount)
+	return true
+}
+
+// removeLogVolume takes the shared log volume and its mounts out of spec
+// again. It reports whether spec changed.
+func removeLogVolume(spec *core.PodSpec) bool {
+	return removeSharedVolume(spec, logVolumeName)
+}
+
+// removeSharedVolume takes the emptyDir name and its mounts out of spec again.
+// It reports whether spec changed.
+func removeSharedVolume(spec *core.PodSpec, name string) bool {
+	changed := false
+	for i, v := range spec.Volumes {
+		if v.Name == name {
+			spec.Volumes = append(spec.Volumes[:i], spec.Volumes[i+1:]...)
+			changed = true
+			break
+		}
+	}
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		for j, m := range container.VolumeMounts {
+			if m.Name == name {
+				container.VolumeMounts = append(container.VolumeMounts[:j], container.VolumeMounts[j+1:]...)
+				changed = true
+				break
+			}
+		}
+	}
+	return changed
+}
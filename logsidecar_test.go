@@ -0,0 +1,92 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+)
+
+// mountedIn returns the names of the containers of spec mounting the volume
+// name.
+func mountedIn(spec *core.PodSpec, name string) []string {
+	var names []string
+	for i := range spec.Containers {
+		if mounted(&spec.Containers[i], name) {
+			names = append(names, spec.Containers[i].Name)
+		}
+	}
+	return names
+}
+
+func TestInjectLogVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantMounted []string
+	}{
+		{name: "all app containers", args: []string{"-log-sidecar"}, wantMounted: []string{"app", "worker", sidecarName}},
+		{name: "primary container", args: []string{"-log-sidecar", "-primary-container=app"}, wantMounted: []string{"app", sidecarName}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			obj := testDeployment("web", nil)
+			obj.Spec.Template.Spec.Containers = append(obj.Spec.Template.Spec.Containers, core.Container{Name: "worker", Image: "worker:1"})
+			dep := asDeployment(obj)
+			sidecar, err := a.desiredSidecar(dep, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sidecar.Image != a.Config.LogSidecarImage || len(sidecar.Ports) != 0 {
+				t.Errorf("sidecar = %+v, want the log shipper without ports", sidecar)
+			}
+			if !a.inject(dep, sidecar) {
+				t.Fatal("sidecar not injected")
+			}
+			spec := &dep.Template.Spec
+			if len(spec.Volumes) != 1 || spec.Volumes[0].Name != logVolumeName || spec.Volumes[0].EmptyDir == nil {
+				t.Errorf("volumes = %+v, want the shared log emptyDir", spec.Volumes)
+			}
+			if got := mountedIn(spec, logVolumeName); !equalStrings(got, tt.wantMounted) {
+				t.Errorf("mounted in %q, want %q", got, tt.wantMounted)
+			}
+			for _, container := range spec.Containers {
+				for _, m := range container.VolumeMounts {
+					if m.Name == logVolumeName && m.MountPath != a.Config.LogSidecarPath {
+						t.Errorf("mounted at %q in %s, want %q", m.MountPath, container.Name, a.Config.LogSidecarPath)
+					}
+				}
+			}
+			if a.inject(dep, sidecar) {
+				t.Errorf("injecting again changed the deployment")
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
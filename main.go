@@ -19,20 +19,38 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/prometheus/common/log"
+	"golang.org/x/time/rate"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	sidecarv1alpha1 "node-sidecar-injector/api/v1alpha1"
+
+	appsv1 "k8s.io/api/apps/v1"
 	core "k8s.io/api/core/v1"
-	extenstionsv1 "k8s.io/api/extensions/v1beta1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -45,6 +63,7 @@ func init() {
 	log.Info(fmt.Sprint("Init first line before adding scheme"))
 	_ = clientgoscheme.AddToScheme(scheme)
 
+	_ = sidecarv1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -59,99 +78,553 @@ func (a *MyReconciler) InjectClient(c client.Client) error {
 }
 
 func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
-	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
-		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
-	flag.Parse()
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	ctrl.SetLogger(zap.Logger(true))
+	for _, setting := range cfg.Describe() {
+		setupLog.Info("setting " + setting)
+	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		LeaderElection:     enableLeaderElection,
+	var auditLog *auditLog
+	if cfg.AuditLog != "" {
+		auditLog, err = openAuditLog(cfg.AuditLog, cfg.AuditLogMaxSize)
+		if err != nil {
+			setupLog.Error(err, "unable to open audit log")
+			os.Exit(1)
+		}
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	stop := ctrl.SetupSignalHandler()
+	err = startWithRetry(cfg.startBackoff(), setupLog, func() error {
+		return run(restConfig, cfg, auditLog, stop)
 	})
 	if err != nil {
-		setupLog.Error(err, "unable to start manager")
+		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+}
 
-	err = builder.
-		ControllerManagedBy(mgr).         // Create the ControllerManagedBy
-		For(&extenstionsv1.Deployment{}). // Deployment is the Application API
-		Owns(&core.Pod{}).                // Deployment owns Pods created by it
-		Complete(&MyReconciler{})
+// run sets up a manager with the controller and its runnables and runs it
+// until stop is closed. A fresh manager is built on every call, so run can be
+// called again after it failed.
+func run(restConfig *rest.Config, cfg *Config, auditLog *auditLog, stop <-chan struct{}) error {
+	options := ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: cfg.MetricsAddr,
+		LeaderElection:     cfg.EnableLeaderElection,
+		LeaseDuration:      &cfg.LeaderElectionLeaseDuration.Duration,
+		RenewDeadline:      &cfg.LeaderElectionRenewDeadline.Duration,
+	}
+	if cfg.ShardCount > 1 {
+		options.LeaderElectionID = shardLeaderElectionID(cfg.ShardIndex)
+	}
+	mgr, err := ctrl.NewManager(restConfig, options)
 	if err != nil {
-		log.Error(err, "could not create controller")
-		os.Exit(1)
+		setupLog.Error(err, "unable to start manager")
+		return err
+	}
+
+	if cfg.SidecarConfigMap != "" {
+		sources, err := sidecarSources(mgr.GetAPIReader(), cfg)
+		if err != nil {
+			setupLog.Error(err, "unable to read sidecar config")
+			return err
+		}
+		var fields map[string]string
+		if cfg.SidecarBase, fields, err = loadSidecarBase(sources...); err != nil {
+			setupLog.Error(err, "invalid sidecar config")
+			return err
+		}
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			setupLog.Info("sidecar config field", "field", name, "source", fields[name])
+		}
+	}
+
+	// deploymentEvents lets runnables outside the controller ask for Deployments to be reconciled,
+	// replicaSetEvents for ReplicaSets
+	deploymentEvents := make(chan event.GenericEvent)
+	var replicaSetEvents chan event.GenericEvent
+	if cfg.InjectReplicaSets {
+		replicaSetEvents = make(chan event.GenericEvent)
+	}
+
+	var exemplars *histogramExemplars
+	if cfg.EnableExemplars {
+		exemplars = rolloutExemplars
+	}
+	reconciler := &MyReconciler{
+		Log:      ctrl.Log.WithName("controllers").WithName("Deployment"),
+		Config:   cfg,
+		Recorder: mgr.GetEventRecorderFor("node-sidecar-injector"),
+		Events:   deploymentEvents,
+		Rollouts: newRolloutTracker(exemplars),
+		Denials:  newAdmissionDenials(),
+		Limiter:  newObjectLimiter(cfg.PerObjectRate, cfg.PerObjectBurst),
+		Backfill: newBackfillLimiter(cfg.BackfillRate),
+		Health:   newReconcileHealth(cfg.ReconcileStalenessLimit.Duration, ctrl.Log.WithName("health")),
+		AuditLog: auditLog,
+
+		APIReader:        mgr.GetAPIReader(),
+		ReplicaSetEvents: replicaSetEvents,
+	}
+	if !cfg.AllowSelfInject {
+		if reconciler.Self, err = selfDeployment(mgr.GetAPIReader()); err != nil {
+			// nothing to guard against when we don't know who we are
+			setupLog.Error(err, "could not find the injector's own deployment, it is not protected from injection")
+		} else if reconciler.Self.Name != "" {
+			setupLog.Info("never injecting the injector's own deployment", "deployment", reconciler.Self)
+		}
+	}
+
+	if cfg.ImageChannel != "" {
+		reconciler.ImageChannel, err = newImageChannel(cfg.ImageChannel, cfg.ImageChannelInterval.Duration)
+		if err != nil {
+			setupLog.Error(err, "invalid image channel")
+			return err
+		}
+		reconciler.ImageChannel.Reader = mgr.GetAPIReader()
+		if reconciler.ImageChannel.key != "" {
+			clientset, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				setupLog.Error(err, "unable to watch image channel")
+				return err
+			}
+			reconciler.ImageChannel.watchConfigMap(clientset)
+		}
+		reconciler.ImageChannel.Enqueue = reconciler.enqueueInjected
+		reconciler.ImageChannel.Log = ctrl.Log.WithName("image-channel")
+		if err := mgr.Add(reconciler.ImageChannel); err != nil {
+			setupLog.Error(err, "unable to add image channel")
+			return err
+		}
+	}
+
+	if cfg.NamespaceInjection {
+		// also the informer the cached client reads namespaces from
+		informer, err := mgr.GetCache().GetInformer(&core.Namespace{})
+		if err != nil {
+			setupLog.Error(err, "unable to watch namespaces")
+			return err
+		}
+		watch := &namespaceWatch{Informer: informer, Enqueue: reconciler.enqueueNamespace, Log: ctrl.Log.WithName("namespaces")}
+		if err := mgr.Add(watch); err != nil {
+			setupLog.Error(err, "unable to add namespace watch")
+			return err
+		}
+	}
+
+	if cfg.VerifyImage {
+		// pull secrets aren't cached, they are only read on lookups
+		registry := &httpRegistry{Client: &http.Client{Timeout: 10 * time.Second}}
+		reconciler.Verifier = newImageVerifier(registry, mgr.GetAPIReader())
+		reconciler.Verifier.Log = ctrl.Log.WithName("image-verifier")
+	}
+
+	if cfg.Report {
+		// one-shot pre-flight overview, nothing is changed
+		go func() {
+			if err := mgr.GetCache().Start(stop); err != nil {
+				setupLog.Error(err, "problem running cache")
+				os.Exit(1)
+			}
+		}()
+		mgr.GetCache().WaitForCacheSync(stop)
+		reconciler.Client = mgr.GetClient()
+		report, err := reconciler.report()
+		if err != nil {
+			setupLog.Error(err, "unable to build report")
+			return err
+		}
+		return report.writeTable(os.Stdout)
+	}
+
+	if cfg.AdminAddr != "" {
+		admin := newAdminServer(cfg.AdminAddr, ctrl.Log.WithName("admin"))
+		admin.HandleJSON("/report", func() (interface{}, error) { return reconciler.report() })
+		admin.HandleJSON("/config", func() (interface{}, error) { return cfg.Effective(), nil })
+		admin.HandleCheck("/readyz", reconciler.Health.Ready)
+		if cfg.EnableExemplars {
+			admin.Handle("/metrics/exemplars", rolloutExemplars)
+		}
+		if err := mgr.Add(admin); err != nil {
+			setupLog.Error(err, "unable to add admin server")
+			return err
+		}
+	}
+
+	controller := builder.
+		ControllerManagedBy(mgr).             // Create the ControllerManagedBy
+		For(newDeployment(cfg.PreferAppsV1)). // Deployment is the Application API
+		// Pods belong to a Deployment through their ReplicaSet
+		Watches(&source.Kind{Type: &core.Pod{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(reconciler.podRequests)}).
+		Watches(&source.Channel{Source: deploymentEvents}, &handler.EnqueueRequestForObject{}).
+		WithEventFilter(shardPredicate(cfg.ShardIndex, cfg.ShardCount))
+	if cfg.EnablePolicies {
+		// a policy edit may change the sidecar of every Deployment in its namespace
+		controller = controller.Watches(&source.Kind{Type: &sidecarv1alpha1.SidecarPolicy{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(reconciler.policyRequests)})
+	}
+	err = controller.Complete(reconciler)
+	if err != nil {
+		setupLog.Error(err, "could not create controller")
+		return err
+	}
+	if cfg.InjectReplicaSets {
+		controller := builder.
+			ControllerManagedBy(mgr).
+			For(&appsv1.ReplicaSet{}).
+			Watches(&source.Channel{Source: replicaSetEvents}, &handler.EnqueueRequestForObject{}).
+			WithEventFilter(standaloneReplicaSets).
+			WithEventFilter(shardPredicate(cfg.ShardIndex, cfg.ShardCount))
+		if cfg.EnablePolicies {
+			controller = controller.Watches(&source.Kind{Type: &sidecarv1alpha1.SidecarPolicy{}},
+				&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(reconciler.policyReplicaSetRequests)})
+		}
+		err = controller.Complete(newReplicaSetReconciler(reconciler))
+		if err != nil {
+			setupLog.Error(err, "could not create replicaset controller")
+			return err
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
-	}
+	return mgr.Start(stop)
 }
 
 // MyReconciler is a simple ControllerManagedBy example implementation.
 type MyReconciler struct {
 	client.Client
+	Log logr.Logger
+
+	Config *Config
+
+	Recorder record.EventRecorder
+
+	// Events asks the controller to reconcile a Deployment, and
+	// ReplicaSetEvents a ReplicaSet with -inject-replicasets.
+	Events           chan<- event.GenericEvent
+	ReplicaSetEvents chan<- event.GenericEvent
+
+	// Rollouts times how long injected Deployments take to roll out.
+	Rollouts *rolloutTracker
+
+	// Denials keeps injections rejected by admission webhooks from being retried.
+	Denials *admissionDenials
+
+	// Limiter delays Deployments that are reconciled too often.
+	Limiter *objectLimiter
+
+	// Backfill paces the Deployments sent to the controller through Events,
+	// shared so backfills running at the same time don't add up.
+	Backfill *rate.Limiter
+
+	// Health disables injection once reconciles stopped succeeding, and
+	// APIReader reads past the cache to tell when they succeed again.
+	Health    *reconcileHealth
+	APIReader client.Reader
+
+	// AuditLog, when set, records every decision.
+	AuditLog *auditLog
+
+	// ImageChannel, when set, supplies the sidecar image tag.
+	ImageChannel *imageChannel
+
+	// Verifier, when set, holds off injection until the sidecar image is in
+	// its registry.
+	Verifier *imageVerifier
+
+	// Self, when set, is the Deployment the injector runs in, which is never
+	// injected.
+	Self types.NamespacedName
 }
 
 // Reconcile method
 // Implement the business logic:
-// This function will be called when there is a change to a ReplicaSet or a Pod with an OwnerReference
-// to a ReplicaSet.
+// This function will be called when there is a change to a Deployment or a Pod with an OwnerReference
+// to a Deployment.
 //
-// * Read the ReplicaSet
+// * While reconciles kept failing for too long, only check the API server is back
+// * Wait for the image channel to be read, if there is one
+// * Read the Deployment, and stop there if it is paused
+// * Inject the sidecar, or re-inject it when its config changed, and commit it on its own
+// * Otherwise record why the Deployment was skipped, and remove the sidecar if it opted out
 // * Read the Pods
-// * Set a Label on the ReplicaSet with the Pod count
-func (a *MyReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
-	// Read the ReplicaSet
-	dep := &extenstionsv1.Deployment{}
-	err := a.Get(context.TODO(), req.NamespacedName, dep)
+// * Set a Label on the Deployment with the Pod count
+//
+// +kubebuilder:rbac:groups=extensions,resources=deployments,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=sidecar.test.com,resources=sidecarpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+func (a *MyReconciler) Reconcile(req reconcile.Request) (result reconcile.Result, err error) {
+	defer func() { a.Health.observe(err) }()
+	obj := newDeployment(a.Config.PreferAppsV1)
+	inj, stop, result, err := a.reconcileSidecar(req, "deployment", obj)
+	if stop {
+		return result, err
+	}
+	dep := asDeployment(obj)
+	if inj.Injected {
+		// the write bumped the generation the Deployment controller rolls out
+		a.Rollouts.start(req.NamespacedName, dep.Generation)
+	}
+	a.Rollouts.observe(req.NamespacedName, dep)
+
+	// List the Pods matching the PodTemplate Labels
+	pods := &core.PodList{}
+	err = a.List(context.TODO(), pods, client.InNamespace(req.Namespace),
+		client.MatchingLabels(dep.Template.Labels))
 	if err != nil {
-		return reconcile.Result{}, err
+		return a.podCountFailed(req, err)
 	}
 
-	// Add Sidecar
-	if val, found := dep.Labels["node-sidecar"]; val == "true" && found {
-		isSidecarRunning := isSidecarRunning(dep)
-		// don't inject if sidecar is already in the deployment
-		if !isSidecarRunning {
-			dep.Spec.Template.Spec.Containers = append(dep.Spec.Template.Spec.Containers, sideCarContainer())
+	// Update the pod count only when it changed
+	podCount := fmt.Sprintf(a.Config.PodCountFormat, len(pods.Items))
+	asLabel := len(validation.IsValidLabelValue(podCount)) == 0
+	var changed bool
+	err = a.update(req.NamespacedName, obj, func(dep *deployment) bool {
+		// the pod count of a denied generation would be denied as well
+		changed = !a.Denials.denied(req.NamespacedName, dep.Generation) && setPodCount(dep, podCount, asLabel)
+		return changed
+	})
+	if changed && !asLabel {
+		// an invalid label value would fail the whole update
+		a.Log.Info("pod count is not a valid label value, writing it as an annotation", "deployment", req.NamespacedName, "value", podCount)
+	}
+	if err != nil && isAdmissionDenied(err) {
+		// terminal for this generation like a denied sidecar, with nothing
+		// left to carry on with
+		a.Denials.deny(req.NamespacedName, dep.Generation)
+		a.Recorder.Event(obj, core.EventTypeWarning, "InjectionDenied", err.Error())
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return a.podCountFailed(req, err)
+	}
+
+	if !a.Config.DisablePerObjectMetrics {
+		lastReconcile.WithLabelValues("deployment", req.Namespace, req.Name).SetToCurrentTime()
+	}
+	if diff := len(pods.Items) - int(dep.StatusReplicas); a.Config.CountDiscrepancyThreshold > 0 && abs(diff) > a.Config.CountDiscrepancyThreshold {
+		// most often a rollout in progress or pods stuck terminating
+		a.Log.Info("pod count diverges from deployment status", "deployment", req.NamespacedName,
+			"pods", len(pods.Items), "replicas", dep.StatusReplicas, "readyReplicas", dep.ReadyReplicas)
+		return reconcile.Result{RequeueAfter: a.Config.CountDiscrepancyRequeue.Duration}, nil
+	}
+	return a.retryUnverified(dep, &inj), nil
+}
+
+// reconcileSidecar is what reconciling Deployments and ReplicaSets have in
+// common: it reads the object of kind named by req into obj and, past every
+// guard, applies the sidecar to it, commits it on its own and records the
+// outcome. With stop set the reconcile ends there with result and err.
+func (a *MyReconciler) reconcileSidecar(req reconcile.Request, kind string, obj runtime.Object) (inj injection, stop bool, result reconcile.Result, err error) {
+	if req.Name == "" {
+		// objects created with generateName only get a name once they are
+		// stored, nothing is keyed on a request without one
+		a.Log.Info("ignoring request without a name", "namespace", req.Namespace)
+		return inj, true, reconcile.Result{}, nil
+	}
+	if delay := a.Limiter.delay(req.NamespacedName); delay > 0 {
+		// most likely another controller rewrites the object every time we do
+		a.Log.Info(kind+" reconciled too often, delaying", kind, req.NamespacedName, "delay", delay)
+		return inj, true, reconcile.Result{RequeueAfter: delay}, nil
+	}
+	if a.Health.Tripped() {
+		// the cache may be stale, only the API server can tell us we're back
+		err := a.APIReader.Get(context.TODO(), req.NamespacedName, obj)
+		if apierrors.IsNotFound(err) {
+			err = nil
 		}
+		a.Health.probe(err)
+		if err != nil {
+			return inj, true, reconcile.Result{}, err
+		}
+		return inj, true, reconcile.Result{Requeue: true}, nil
+	}
+	if a.ImageChannel != nil && a.ImageChannel.Tag() == "" {
+		// injecting the default tag now would roll the fleet again once the
+		// channel was read
+		return inj, true, reconcile.Result{RequeueAfter: a.ImageChannel.Interval}, nil
 	}
 
-	err = a.Update(context.TODO(), dep)
+	err = a.Get(context.TODO(), req.NamespacedName, obj)
+	if apierrors.IsNotFound(err) {
+		a.forget(kind, req.NamespacedName)
+		return inj, true, reconcile.Result{}, nil
+	}
 	if err != nil {
-		return reconcile.Result{}, err
+		return inj, true, reconcile.Result{}, err
+	}
+	dep := asDeployment(obj)
+	if paused(dep) {
+		// no injection, no pod count, nothing until the annotation is gone
+		return inj, true, reconcile.Result{}, nil
+	}
+	if _, rs := obj.(*appsv1.ReplicaSet); rs && !standalone(dep) {
+		// adopted by a Deployment since the event, which carries the sidecar now
+		return inj, true, reconcile.Result{}, nil
 	}
 
-	return reconcile.Result{}, nil
+	// Add Sidecar, or record why it was skipped, and commit it before touching
+	// anything else so a failed update later on can't take the sidecar down with it
+	err = a.update(req.NamespacedName, obj, func(dep *deployment) bool {
+		return a.applySidecar(dep, &inj)
+	})
+	a.recordInjection(obj, kind, req.NamespacedName, &inj)
+	if err != nil && isAdmissionDenied(err) {
+		// terminal for this generation, whether the sidecar or only its
+		// annotations were written, requeue to carry on without changing it
+		a.Denials.deny(req.NamespacedName, dep.Generation)
+		a.Recorder.Event(obj, core.EventTypeWarning, "InjectionDenied", err.Error())
+		return inj, true, reconcile.Result{Requeue: true}, nil
+	}
+	if err != nil {
+		return inj, true, reconcile.Result{}, err
+	}
+	a.summarize(obj, &inj)
+	switch {
+	case inj.Removed:
+		a.Log.Info("removed sidecar", kind, req.NamespacedName)
+		a.audit(kind, req.NamespacedName, decisionRemove, "")
+	case inj.Reason != "":
+		a.audit(kind, req.NamespacedName, decisionSkip, inj.Reason)
+	case inj.Injected && inj.HadSidecar:
+		a.audit(kind, req.NamespacedName, decisionUpdate, "")
+	case inj.Injected:
+		a.audit(kind, req.NamespacedName, decisionInject, "")
+	}
+	return inj, false, reconcile.Result{}, nil
+}
+
+// retryUnverified returns the result for dep once it was reconciled: a
+// requeue for when the sidecar image is looked up again if inj was skipped
+// because it wasn't found, nothing otherwise.
+func (a *MyReconciler) retryUnverified(dep *deployment, inj *injection) reconcile.Result {
+	if inj.Reason != skipImageUnverified {
+		return reconcile.Result{}
+	}
+	// inject once the image shows up in its registry
+	return reconcile.Result{RequeueAfter: a.Verifier.retryIn(dep, inj.Sidecar.Image)}
 }
 
-func sideCarContainer() core.Container {
-	return core.Container{
-		Image: "aminmithil/node-demo:latest",
-		Name:  "node-sidecar",
-		Ports: []core.ContainerPort{
-			core.ContainerPort{
-				ContainerPort: 8081,
-				Protocol:      "TCP",
-			},
-		},
+// recordInjection emits the events and logs for the outcome inj of applying
+// the sidecar to obj, a kind named key.
+func (a *MyReconciler) recordInjection(obj runtime.Object, kind string, key types.NamespacedName, inj *injection) {
+	if inj.Err != nil && inj.Reason == skipPolicyInvalid {
+		a.Recorder.Event(obj, core.EventTypeWarning, "InvalidSidecarPolicy", inj.Err.Error())
+	} else if inj.Err != nil {
+		a.Recorder.Event(obj, core.EventTypeWarning, "SidecarTemplateError", inj.Err.Error())
 	}
+	switch {
+	case inj.Reason == skipForeignInjector:
+		a.Recorder.Eventf(obj, core.EventTypeWarning, "InjectorConflict", "sidecar was injected by %s, not by %s", inj.Foreign, a.Config.InstanceID)
+	case inj.Foreign != "" && inj.Reason == "":
+		// another instance, or this one before its instance-id changed
+		a.Log.Info("adopting "+kind+" injected by another injector", kind, key, "instance", inj.Foreign)
+	}
+	if inj.Reason != "" && inj.Reason != skipSelectorMismatch {
+		a.Log.Info("not injecting", kind, key, "reason", inj.Reason)
+	}
+}
+
+// summarize emits the SidecarInjected event with -summary-event, once for
+// every config of the sidecar committed to obj.
+func (a *MyReconciler) summarize(obj runtime.Object, inj *injection) {
+	if a.Config.SummaryEvent && inj.SidecarChanged {
+		a.Recorder.Event(obj, core.EventTypeNormal, "SidecarInjected", sidecarSummary(inj.Sidecar, sidecarHash(inj.Sidecar)))
+	}
+}
+
+// forget drops everything kept about the deleted object key of kind.
+func (a *MyReconciler) forget(kind string, key types.NamespacedName) {
+	a.Rollouts.forget(key)
+	a.Denials.forget(key)
+	a.Limiter.forget(key)
+	a.AuditLog.forget(kind, key)
+	lastReconcile.DeleteLabelValues(kind, key.Namespace, key.Name)
 }
 
-func isSidecarRunning(rs *extenstionsv1.Deployment) bool {
-	for _, container := range rs.Spec.Template.Spec.Containers {
-		if container.Name == "node-sidecar" {
-			return true
+// update applies mutate to the Deployment obj read from key and writes it
+// back when mutate reports a change. On conflicts the Deployment is read again
+// and mutate applied to the fresh copy, backing off with jitter so concurrent
+// writers don't retry in lockstep.
+func (a *MyReconciler) update(key types.NamespacedName, obj runtime.Object, mutate func(*deployment) bool) error {
+	attempt := 0
+	return retry.RetryOnConflict(a.Config.conflictBackoff(), func() error {
+		if attempt++; attempt > 1 {
+			if err := a.Get(context.TODO(), key, obj); err != nil {
+				return err
+			}
 		}
+		if !mutate(asDeployment(obj)) {
+			return nil
+		}
+		return a.write(obj)
+	})
+}
+
+// audit appends a committed decision about key of kind to the audit log, if
+// one is configured.
+func (a *MyReconciler) audit(kind string, key types.NamespacedName, decision, reason string) {
+	if err := a.AuditLog.record(kind, key, decision, reason); err != nil {
+		a.Log.Error(err, "could not write audit log", kind, key)
+	}
+}
+
+// setPodCount writes value to obj's pod-count label, or to its pod-count
+// annotation when asLabel is false, and removes the other one. It reports
+// whether obj changed.
+func setPodCount(obj metav1.Object, value string, asLabel bool) bool {
+	labels, annotations := obj.GetLabels(), obj.GetAnnotations()
+	set, other := &labels, &annotations
+	if !asLabel {
+		set, other = other, set
+	}
+	_, stale := (*other)["pod-count"]
+	if (*set)["pod-count"] == value && !stale {
+		return false
+	}
+	if *set == nil {
+		*set = map[string]string{}
+	}
+	(*set)["pod-count"] = value
+	delete(*other, "pod-count")
+	obj.SetLabels(labels)
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// podCountFailed reports a failed pod-count read or write. In best-effort mode
+// the sidecar has already been committed, so the Deployment is only requeued
+// to retry the count.
+func (a *MyReconciler) podCountFailed(req reconcile.Request, err error) (reconcile.Result, error) {
+	if a.Config.PodCountBestEffort {
+		a.Log.Error(err, "could not update pod count, requeueing", "deployment", req.NamespacedName)
+		return reconcile.Result{Requeue: true}, nil
 	}
-	return false
+	return reconcile.Result{}, err
 }
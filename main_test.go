@@ -0,0 +1,644 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	dto "github.com/prometheus/client_model/go"
+	core "k8s.io/api/core/v1"
+	extenstionsv1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// testConfig returns the config loaded from args, failing t if it is invalid.
+func testConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatalf("loadConfig(%q): %v", args, err)
+	}
+	return cfg
+}
+
+// testReconciler returns a reconciler reading and writing objs through a fake
+// client.
+func testReconciler(cfg *Config, objs ...runtime.Object) *MyReconciler {
+	c := fake.NewFakeClientWithScheme(scheme, objs...)
+	return &MyReconciler{
+		Client:    c,
+		Log:       ctrl.Log.WithName("test"),
+		Config:    cfg,
+		Recorder:  record.NewFakeRecorder(100),
+		Rollouts:  newRolloutTracker(nil),
+		Denials:   newAdmissionDenials(),
+		Limiter:   newObjectLimiter(cfg.PerObjectRate, cfg.PerObjectBurst),
+		Health:    newReconcileHealth(cfg.ReconcileStalenessLimit.Duration, ctrl.Log.WithName("test")),
+		APIReader: c,
+	}
+}
+
+// testDeployment returns a Deployment in namespace default labelled labels,
+// running one app container.
+func testDeployment(name string, labels map[string]string) *extenstionsv1.Deployment {
+	return &extenstionsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Spec: extenstionsv1.DeploymentSpec{
+			Template: core.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+				Spec: core.PodSpec{Containers: []core.Container{{
+					Name:  "app",
+					Image: "app:1",
+					Ports: []core.ContainerPort{{ContainerPort: 8080, Protocol: "TCP"}},
+				}}},
+			},
+		},
+	}
+}
+
+// testPod returns a pod of the Deployment name.
+func testPod(name, deployment string) *core.Pod {
+	return &core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"app": deployment}}}
+}
+
+// stored returns the stored Deployment name, failing t if it can't be read.
+func stored(t *testing.T, c client.Client, name string) *deployment {
+	t.Helper()
+	obj := &extenstionsv1.Deployment{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, obj); err != nil {
+		t.Fatalf("get deployment %s: %v", name, err)
+	}
+	return asDeployment(obj)
+}
+
+func request(name string) reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+}
+
+// failingClient fails the updates fail returns an error for.
+type failingClient struct {
+	client.Client
+	updates int
+	fail    func(attempt int, obj runtime.Object) error
+}
+
+func (c *failingClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	c.updates++
+	if err := c.fail(c.updates, obj); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// failPodCount fails every update writing a pod count.
+func failPodCount(_ int, obj runtime.Object) error {
+	if _, found := asDeployment(obj).Labels["pod-count"]; found {
+		return apierrors.NewServiceUnavailable("pod count")
+	}
+	return nil
+}
+
+// logRecorder is a logr.Logger keeping the messages logged through it.
+type logRecorder struct {
+	messages *[]string
+}
+
+func newLogRecorder() logRecorder {
+	return logRecorder{messages: new([]string)}
+}
+
+func (l logRecorder) Info(msg string, _ ...interface{}) { *l.messages = append(*l.messages, msg) }
+func (l logRecorder) Enabled() bool                     { return true }
+func (l logRecorder) Error(_ error, msg string, _ ...interface{}) {
+	*l.messages = append(*l.messages, msg)
+}
+func (l logRecorder) V(int) logr.InfoLogger                 { return l }
+func (l logRecorder) WithValues(...interface{}) logr.Logger { return l }
+func (l logRecorder) WithName(string) logr.Logger           { return l }
+
+// logged reports whether msg was logged.
+func (l logRecorder) logged(msg string) bool {
+	for _, m := range *l.messages {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconcileInjects(t *testing.T) {
+	fsGroup := int64(1000)
+	long := strings.Repeat("x", 63) + "-%d"
+	tests := []struct {
+		name   string
+		args   []string
+		mutate func(obj *extenstionsv1.Deployment)
+		check  func(t *testing.T, a *MyReconciler, dep *deployment)
+	}{
+		{name: "defaults", check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+			if dep.Annotations[sidecarHashAnnotation] == "" {
+				t.Errorf("config hash not recorded: %v", dep.Annotations)
+			}
+			if got := dep.Labels["pod-count"]; got != "2" {
+				t.Errorf("pod-count = %q, want 2", got)
+			}
+			if dep.Template.Spec.SecurityContext != nil && dep.Template.Spec.SecurityContext.FSGroup != nil {
+				t.Errorf("fsGroup set without -sidecar-fs-group")
+			}
+		}},
+		{name: "fs group set", args: []string{"-sidecar-fs-group=2000"}, check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+			if sc := dep.Template.Spec.SecurityContext; sc == nil || sc.FSGroup == nil || *sc.FSGroup != 2000 {
+				t.Errorf("pod security context = %+v, want fsGroup 2000", sc)
+			}
+		}},
+		{
+			name: "fs group not clobbered",
+			args: []string{"-sidecar-fs-group=2000"},
+			mutate: func(obj *extenstionsv1.Deployment) {
+				obj.Spec.Template.Spec.SecurityContext = &core.PodSecurityContext{FSGroup: &fsGroup}
+			},
+			check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+				if got := *dep.Template.Spec.SecurityContext.FSGroup; got != fsGroup {
+					t.Errorf("fsGroup = %d, want the deployment's %d", got, fsGroup)
+				}
+			},
+		},
+		{name: "injected by", args: []string{"-instance-id=injector-a"}, check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+			if got := dep.Annotations[injectedByAnnotation]; got != "injector-a" {
+				t.Errorf("injected-by = %q, want injector-a", got)
+			}
+		}},
+		{
+			name: "service account set if empty",
+			args: []string{"-require-service-account=mesh", "-set-service-account"},
+			check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+				if got := dep.Template.Spec.ServiceAccountName; got != "mesh" {
+					t.Errorf("service account = %q, want mesh", got)
+				}
+			},
+		},
+		{
+			name: "pod count overflowing a label",
+			args: []string{"-pod-count-format=" + long},
+			check: func(t *testing.T, a *MyReconciler, dep *deployment) {
+				if _, found := dep.Labels["pod-count"]; found {
+					t.Errorf("pod count written as an invalid label")
+				}
+				if got, want := dep.Annotations["pod-count"], fmt.Sprintf(long, 2); got != want {
+					t.Errorf("pod-count annotation = %q, want %q", got, want)
+				}
+			},
+		},
+		{
+			name: "minimally populated",
+			mutate: func(obj *extenstionsv1.Deployment) {
+				obj.GenerateName = "web-"
+				obj.Spec.Template.Labels = nil
+				obj.Spec.Template.Spec.Containers[0].Ports = nil
+			},
+			check: func(t *testing.T, a *MyReconciler, dep *deployment) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := testDeployment("web", map[string]string{"node-sidecar": "true"})
+			if tt.mutate != nil {
+				tt.mutate(obj)
+			}
+			a := testReconciler(testConfig(t, tt.args...), obj, testPod("web-1", "web"), testPod("web-2", "web"))
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			dep := stored(t, a.Client, "web")
+			if sidecarIndex(&dep.Template.Spec) < 0 {
+				t.Errorf("sidecar not injected: %+v", dep.Template.Spec.Containers)
+			}
+			tt.check(t, a, dep)
+		})
+	}
+}
+
+func TestReconcileLeavesAlone(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(obj *extenstionsv1.Deployment)
+		request reconcile.Request
+		resume  func(obj runtime.Object)
+	}{
+		{
+			name:   "paused",
+			mutate: func(obj *extenstionsv1.Deployment) { obj.Annotations = map[string]string{pausedAnnotation: "true"} },
+			resume: func(obj runtime.Object) { delete(asDeployment(obj).Annotations, pausedAnnotation) },
+		},
+		{name: "request without a name", request: reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := testDeployment("web", map[string]string{"node-sidecar": "true"})
+			if tt.mutate != nil {
+				tt.mutate(obj)
+			}
+			a := testReconciler(testConfig(t), obj, testPod("web-1", "web"))
+			req := tt.request
+			if req == (reconcile.Request{}) {
+				req = request("web")
+			}
+			c := &failingClient{Client: a.Client, fail: func(int, runtime.Object) error { return nil }}
+			a.Client = c
+			if result, err := a.Reconcile(req); err != nil || result != (reconcile.Result{}) {
+				t.Fatalf("Reconcile() = %+v, %v", result, err)
+			}
+			if c.updates != 0 {
+				t.Errorf("deployment written %d times", c.updates)
+			}
+			if tt.resume == nil {
+				return
+			}
+			live := stored(t, a.Client, "web")
+			tt.resume(live.Object)
+			if err := a.Update(context.TODO(), live.Object); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Reconcile(req); err != nil {
+				t.Fatal(err)
+			}
+			if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) < 0 || dep.Labels["pod-count"] != "1" {
+				t.Errorf("not resumed: %+v", dep.ObjectMeta)
+			}
+		})
+	}
+}
+
+func TestReconcileSkipsWithoutLabel(t *testing.T) {
+	a := testReconciler(testConfig(t), testDeployment("web", nil))
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) >= 0 {
+		t.Errorf("sidecar injected without opting in")
+	}
+}
+
+func TestReconcileInjectionSurvivesPodCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		bestEffort bool
+		wantErr    bool
+		wantResult reconcile.Result
+	}{
+		{name: "strict", wantErr: true},
+		{name: "best effort", bestEffort: true, wantResult: reconcile.Result{Requeue: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.bestEffort {
+				args = append(args, "-pod-count-best-effort")
+			}
+			a := testReconciler(testConfig(t, args...), testDeployment("web", map[string]string{"node-sidecar": "true"}), testPod("web-1", "web"))
+			c := &failingClient{Client: a.Client, fail: failPodCount}
+			a.Client = c
+			result, err := a.Reconcile(request("web"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Reconcile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if result != tt.wantResult {
+				t.Errorf("Reconcile() = %+v, want %+v", result, tt.wantResult)
+			}
+			if dep := stored(t, c.Client, "web"); sidecarIndex(&dep.Template.Spec) < 0 {
+				t.Errorf("failed pod count took the sidecar down with it")
+			}
+		})
+	}
+}
+
+func TestReconcileRetriesConflicts(t *testing.T) {
+	a := testReconciler(testConfig(t, "-conflict-retry-duration=1ms", "-conflict-retry-jitter=1"), testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	c := &failingClient{Client: a.Client, fail: func(attempt int, _ runtime.Object) error {
+		if attempt <= 3 {
+			return apierrors.NewConflict(schema.GroupResource{Group: "extensions", Resource: "deployments"}, "web", errors.New("modified"))
+		}
+		return nil
+	}}
+	a.Client = c
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if dep := stored(t, c.Client, "web"); sidecarIndex(&dep.Template.Spec) < 0 {
+		t.Errorf("sidecar not injected after conflicts")
+	}
+}
+
+func TestReconcileLastReconcileMetric(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantSet bool
+	}{
+		{name: "per object metrics", wantSet: true},
+		{name: "disabled", args: []string{"-disable-per-object-metrics"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lastReconcile.Reset()
+			a := testReconciler(testConfig(t, tt.args...), testDeployment("web", map[string]string{"node-sidecar": "true"}))
+			before := time.Now()
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantSet {
+				if lastReconcile.DeleteLabelValues("deployment", "default", "web") {
+					t.Errorf("last reconcile recorded with per object metrics disabled")
+				}
+				return
+			}
+			m := &dto.Metric{}
+			if err := lastReconcile.WithLabelValues("deployment", "default", "web").Write(m); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.GetGauge().GetValue(); got < float64(before.Unix()) {
+				t.Errorf("last reconcile = %v, want at least %v", got, before.Unix())
+			}
+
+			// deleted, the series goes with it
+			if err := a.Delete(context.TODO(), testDeployment("web", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			if lastReconcile.DeleteLabelValues("deployment", "default", "web") {
+				t.Errorf("series of the deleted deployment kept")
+			}
+		})
+	}
+}
+
+func TestReconcileAdmissionDenied(t *testing.T) {
+	a := testReconciler(testConfig(t, "-annotate-skip-reason"), testDeployment("web", nil))
+	denied := apierrors.NewForbidden(schema.GroupResource{Group: "extensions", Resource: "deployments"}, "web",
+		errors.New(`admission webhook "policy.example.com" denied the request`))
+	c := &failingClient{Client: a.Client, fail: func(int, runtime.Object) error { return denied }}
+	a.Client = c
+
+	// only the skip reason is written, and denied
+	result, err := a.Reconcile(request("web"))
+	if err != nil || !result.Requeue {
+		t.Fatalf("Reconcile() = %+v, %v, want a requeue", result, err)
+	}
+	if !a.Denials.denied(request("web").NamespacedName, 0) {
+		t.Errorf("denial not recorded")
+	}
+	recorder := a.Recorder.(*record.FakeRecorder)
+	if len(recorder.Events) != 1 {
+		t.Errorf("got %d events, want the InjectionDenied event", len(recorder.Events))
+	}
+
+	updates := c.updates
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if c.updates != updates {
+		t.Errorf("denied generation was written again %d times", c.updates-updates)
+	}
+
+	// a denied pod count is terminal as well, after the sidecar went in
+	a = testReconciler(testConfig(t), testDeployment("web", map[string]string{"node-sidecar": "true"}), testPod("web-1", "web"))
+	a.Client = &failingClient{Client: a.Client, fail: func(_ int, obj runtime.Object) error {
+		if _, found := asDeployment(obj).Labels["pod-count"]; found {
+			return denied
+		}
+		return nil
+	}}
+	if result, err := a.Reconcile(request("web")); err != nil || result.Requeue {
+		t.Fatalf("Reconcile() = %+v, %v, want neither an error nor a requeue", result, err)
+	}
+	if !a.Denials.denied(request("web").NamespacedName, 0) {
+		t.Errorf("pod count denial not recorded")
+	}
+}
+
+func TestReconcileCountDiscrepancy(t *testing.T) {
+	const warning = "pod count diverges from deployment status"
+	tests := []struct {
+		name        string
+		args        []string
+		replicas    int32
+		wantRequeue time.Duration
+	}{
+		{name: "disabled", replicas: 5},
+		{name: "within threshold", args: []string{"-count-discrepancy-threshold=2"}, replicas: 3},
+		{name: "beyond threshold", args: []string{"-count-discrepancy-threshold=2"}, replicas: 5, wantRequeue: 30 * time.Second},
+		{
+			name:        "custom requeue",
+			args:        []string{"-count-discrepancy-threshold=2", "-count-discrepancy-requeue=5s"},
+			replicas:    5,
+			wantRequeue: 5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := testDeployment("web", map[string]string{"node-sidecar": "true"})
+			obj.Status.Replicas = tt.replicas
+			a := testReconciler(testConfig(t, tt.args...), obj, testPod("web-1", "web"))
+			log := newLogRecorder()
+			a.Log = log
+			result, err := a.Reconcile(request("web"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RequeueAfter != tt.wantRequeue {
+				t.Errorf("RequeueAfter = %v, want %v", result.RequeueAfter, tt.wantRequeue)
+			}
+			if got := log.logged(warning); got != (tt.wantRequeue > 0) {
+				t.Errorf("warned = %v, want %v", got, tt.wantRequeue > 0)
+			}
+			if got := stored(t, a.Client, "web").Labels["pod-count"]; got != "1" {
+				t.Errorf("pod-count = %q, want the listed count 1", got)
+			}
+		})
+	}
+}
+
+func TestReconcileSummaryEvent(t *testing.T) {
+	a := testReconciler(testConfig(t, "-summary-event", "-sidecar-cpu-request=50m", "-sidecar-memory-limit=64Mi"),
+		testDeployment("web", map[string]string{"node-sidecar": "true"}), testPod("web-1", "web"))
+	recorder := a.Recorder.(*record.FakeRecorder)
+	events := func() []string {
+		var got []string
+		for len(recorder.Events) > 0 {
+			got = append(got, <-recorder.Events)
+		}
+		return got
+	}
+
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	dep := stored(t, a.Client, "web")
+	want := fmt.Sprintf("Normal SidecarInjected injected %s with image %s, ports %d/TCP, requests cpu=50m, limits memory=64Mi, config hash %s",
+		sidecarName, a.sidecarImage(), sidecarPort, dep.Annotations[sidecarHashAnnotation])
+	if got := events(); len(got) != 1 || got[0] != want {
+		t.Errorf("events = %q, want [%q]", got, want)
+	}
+
+	// nothing new about the sidecar, only the pod count
+	if err := a.Create(context.TODO(), testPod("web-2", "web")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if stored(t, a.Client, "web").Labels["pod-count"] != "2" {
+		t.Fatalf("pod count not updated")
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("events for an unchanged sidecar config = %q, want none", got)
+	}
+
+	a.Config.SidecarCPURequest = "100m"
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if got := events(); len(got) != 1 || !strings.Contains(got[0], "requests cpu=100m") {
+		t.Errorf("events after a config change = %q, want one summary with the new request", got)
+	}
+}
+
+func TestReconcileTripped(t *testing.T) {
+	cfg := testConfig(t, "-reconcile-staleness-limit=1ns")
+	a := testReconciler(cfg, testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	a.Health.observe(errors.New("api server down"))
+	for i := 1; i <= recoveryProbes; i++ {
+		if !a.Health.Tripped() {
+			t.Fatalf("enabled again after %d reads from the API server, want %d", i-1, recoveryProbes)
+		}
+		result, err := a.Reconcile(request("web"))
+		if err != nil || !result.Requeue {
+			t.Fatalf("Reconcile() = %+v, %v, want a requeue", result, err)
+		}
+		if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) >= 0 {
+			t.Errorf("sidecar injected while tripped")
+		}
+	}
+	if a.Health.Tripped() {
+		t.Errorf("still tripped after %d reads from the API server", recoveryProbes)
+	}
+}
+
+func TestReconcileWaitsForImageChannel(t *testing.T) {
+	const source = "configmap:default/channel/tag"
+	cfg := testConfig(t, "-image-channel="+source)
+	a := testReconciler(cfg, testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	a.ImageChannel, _ = newImageChannel(source, cfg.ImageChannelInterval.Duration)
+	result, err := a.Reconcile(request("web"))
+	if err != nil || result.RequeueAfter != cfg.ImageChannelInterval.Duration {
+		t.Fatalf("Reconcile() = %+v, %v, want a requeue after %v", result, err, cfg.ImageChannelInterval.Duration)
+	}
+	if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) >= 0 {
+		t.Errorf("sidecar injected before the image channel was read")
+	}
+}
+
+func TestReconcileNamespaceInjection(t *testing.T) {
+	namespace := &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"node-sidecar": "true"}}}
+	tests := []struct {
+		name        string
+		objs        []runtime.Object
+		wantSidecar bool
+	}{
+		{name: "namespace opted in", objs: []runtime.Object{namespace, testDeployment("web", nil)}, wantSidecar: true},
+		{name: "deployment opted out", objs: []runtime.Object{namespace, testDeployment("web", map[string]string{"node-sidecar": "false"})}},
+		{name: "namespace unknown", objs: []runtime.Object{testDeployment("web", nil)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, "-namespace-injection"), tt.objs...)
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			if got := sidecarIndex(&stored(t, a.Client, "web").Template.Spec) >= 0; got != tt.wantSidecar {
+				t.Errorf("sidecar injected = %v, want %v", got, tt.wantSidecar)
+			}
+		})
+	}
+}
+
+func TestReconcileRemoval(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantSidecar bool
+		wantRestart bool
+	}{
+		{name: "kept by default", wantSidecar: true},
+		{name: "removed on opt-out", args: []string{"-remove-on-opt-out"}},
+		{name: "restarted on removal", args: []string{"-remove-on-opt-out", "-restart-on-removal", "-restart-annotation=example.com/restartedAt"}, wantRestart: true},
+		{name: "kept on a namespace cache miss", args: []string{"-remove-on-opt-out", "-namespace-injection"}, wantSidecar: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.args...)
+			a := testReconciler(cfg, testDeployment("web", map[string]string{"node-sidecar": "true"}))
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			// opt out again
+			live := stored(t, a.Client, "web")
+			delete(live.Labels, "node-sidecar")
+			if err := a.Update(context.TODO(), live.Object); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Reconcile(request("web")); err != nil {
+				t.Fatal(err)
+			}
+			dep := stored(t, a.Client, "web")
+			if got := sidecarIndex(&dep.Template.Spec) >= 0; got != tt.wantSidecar {
+				t.Errorf("sidecar present = %v, want %v", got, tt.wantSidecar)
+			}
+			if _, got := dep.Template.Annotations["example.com/restartedAt"]; got != tt.wantRestart {
+				t.Errorf("restart annotation set = %v, want %v", got, tt.wantRestart)
+			}
+		})
+	}
+}
+
+func TestReconcileDeleted(t *testing.T) {
+	a := testReconciler(testConfig(t))
+	a.Denials.deny(request("gone").NamespacedName, 1)
+	if _, err := a.Reconcile(request("gone")); err != nil {
+		t.Fatal(err)
+	}
+	if a.Denials.denied(request("gone").NamespacedName, 1) {
+		t.Errorf("denial of the deleted deployment kept")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var rolloutDurationOpts = prometheus.HistogramOpts{
+	Name:    "node_sidecar_rollout_duration_seconds",
+	Help:    "Time from injecting the sidecar into a Deployment until all of its replicas are updated and available.",
+	Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+}
+
+var rolloutDuration = prometheus.NewHistogram(rolloutDurationOpts)
+
+// rolloutExemplars are served with -enable-exemplars.
+var rolloutExemplars = newHistogramExemplars(rolloutDuration, rolloutDurationOpts)
+
+// lastReconcile has one series per Deployment or ReplicaSet, so it can be
+// turned off with -disable-per-object-metrics on clusters with many of them.
+var lastReconcile = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "node_sidecar_last_reconcile_timestamp_seconds",
+	Help: "Unix time of the last successful reconcile of a Deployment or ReplicaSet.",
+}, []string{"kind", "namespace", "name"})
+
+func init() {
+	metrics.Registry.MustRegister(rolloutDuration, lastReconcile)
+}
+
+// rolloutTracker remembers when the sidecar was injected into a Deployment,
+// and the generation that did it, so the rollout can be timed once the
+// Deployment controller reports every replica of that generation available.
+// Every timing is recorded in exemplars as well.
+type rolloutTracker struct {
+	exemplars *histogramExemplars
+
+	mu      sync.Mutex
+	started map[types.NamespacedName]rollout
+}
+
+type rollout struct {
+	at         time.Time
+	generation int64
+}
+
+func newRolloutTracker(exemplars *histogramExemplars) *rolloutTracker {
+	return &rolloutTracker{exemplars: exemplars, started: map[types.NamespacedName]rollout{}}
+}
+
+// start records that the sidecar was just injected into key, making it
+// generation.
+func (t *rolloutTracker) start(key types.NamespacedName, generation int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started[key] = rollout{at: time.Now(), generation: generation}
+}
+
+// observe checks whether dep rolled out the generation the sidecar was
+// injected with, all of its replicas updated and available, and if so records
+// how long the rollout took.
+func (t *rolloutTracker) observe(key types.NamespacedName, dep *deployment) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	started, found := t.started[key]
+	if !found {
+		return
+	}
+	if sidecarIndex(&dep.Template.Spec) < 0 {
+		// the sidecar is gone again, nothing to wait for
+		delete(t.started, key)
+		return
+	}
+	replicas := int32(1)
+	if dep.Replicas != nil {
+		replicas = *dep.Replicas
+	}
+	if dep.ObservedGeneration < started.generation ||
+		dep.UpdatedReplicas != replicas || dep.StatusReplicas != replicas || dep.AvailableReplicas != replicas {
+		return
+	}
+	took := time.Since(started.at).Seconds()
+	rolloutDuration.Observe(took)
+	t.exemplars.record(key, took)
+	delete(t.started, key)
+}
+
+// forget drops key, e.g. because the Deployment was deleted.
+func (t *rolloutTracker) forget(key types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.started, key)
+}
@@ -0,0 +1,69 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRolloutTracker(t *testing.T) {
+	two := int32(2)
+	tests := []struct {
+		name     string
+		status   func(dep *deployment)
+		removed  bool
+		wantDone bool
+	}{
+		{name: "not observed yet", status: func(dep *deployment) {
+			dep.ObservedGeneration, dep.UpdatedReplicas, dep.StatusReplicas, dep.AvailableReplicas = 1, 2, 2, 2
+		}},
+		{name: "old pods still around", status: func(dep *deployment) {
+			dep.ObservedGeneration, dep.UpdatedReplicas, dep.StatusReplicas, dep.AvailableReplicas = 2, 2, 3, 2
+		}},
+		{name: "not available yet", status: func(dep *deployment) {
+			dep.ObservedGeneration, dep.UpdatedReplicas, dep.StatusReplicas, dep.AvailableReplicas = 2, 2, 2, 1
+		}},
+		{name: "rolled out", status: func(dep *deployment) {
+			dep.ObservedGeneration, dep.UpdatedReplicas, dep.StatusReplicas, dep.AvailableReplicas = 2, 2, 2, 2
+		}, wantDone: true},
+		{name: "later generation rolled out", status: func(dep *deployment) {
+			dep.ObservedGeneration, dep.UpdatedReplicas, dep.StatusReplicas, dep.AvailableReplicas = 3, 2, 2, 2
+		}, wantDone: true},
+		{name: "sidecar removed again", status: func(dep *deployment) {}, removed: true, wantDone: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := testDeployment("web", nil)
+			obj.Spec.Replicas = &two
+			if !tt.removed {
+				obj.Spec.Template.Spec.Containers = append(obj.Spec.Template.Spec.Containers, core.Container{Name: sidecarName})
+			}
+			dep := asDeployment(obj)
+			tt.status(dep)
+
+			key := types.NamespacedName{Namespace: "default", Name: "web"}
+			tracker := newRolloutTracker(nil)
+			tracker.start(key, 2)
+			tracker.observe(key, dep)
+			if _, waiting := tracker.started[key]; waiting == tt.wantDone {
+				t.Errorf("still waiting = %v, want %v", waiting, !tt.wantDone)
+			}
+		})
+	}
+}
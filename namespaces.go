@@ -0,0 +1,75 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// namespaceWatch is fed by the namespace informer as a ResourceEventHandler,
+// and calls Enqueue with a namespace whose node-sidecar label flipped so its
+// Deployments are reconciled with the new state. Reconcile reads the label
+// from the manager's cache, which the same informer keeps up to date, so it
+// doesn't have to ask the API server every time.
+//
+// It is a manager runnable that only subscribes to Informer once elected, as
+// nothing drains the enqueued events on a standby replica.
+type namespaceWatch struct {
+	Informer interface {
+		AddEventHandler(handler toolscache.ResourceEventHandler)
+	}
+	Enqueue func(namespace string) error
+	Log     logr.Logger
+}
+
+// Start implements manager.Runnable.
+func (w *namespaceWatch) Start(stop <-chan struct{}) error {
+	w.Informer.AddEventHandler(w)
+	<-stop
+	return nil
+}
+
+// namespaceEnabled reports whether ns opted all its Deployments into the
+// sidecar.
+func namespaceEnabled(ns *core.Namespace) bool {
+	return ns.Labels["node-sidecar"] == "true"
+}
+
+// OnAdd implements toolscache.ResourceEventHandler. Namespaces seen for the
+// first time need nothing, their Deployments are reconciled anyway.
+func (w *namespaceWatch) OnAdd(interface{}) {}
+
+// OnUpdate implements toolscache.ResourceEventHandler.
+func (w *namespaceWatch) OnUpdate(oldObj, newObj interface{}) {
+	old, ok := oldObj.(*core.Namespace)
+	ns, ok2 := newObj.(*core.Namespace)
+	if !ok || !ok2 || namespaceEnabled(old) == namespaceEnabled(ns) {
+		return
+	}
+	w.Log.Info("namespace injection changed", "namespace", ns.Name, "enabled", namespaceEnabled(ns))
+	// the enqueues are paced, which mustn't hold up the other namespace events
+	go func() {
+		if err := w.Enqueue(ns.Name); err != nil {
+			w.Log.Error(err, "could not enqueue deployments", "namespace", ns.Name)
+		}
+	}()
+}
+
+// OnDelete implements toolscache.ResourceEventHandler. The Deployments of a
+// deleted namespace go with it.
+func (w *namespaceWatch) OnDelete(interface{}) {}
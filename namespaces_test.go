@@ -0,0 +1,99 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestNamespaceWatch(t *testing.T) {
+	namespace := func(label string) *core.Namespace {
+		ns := &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+		if label != "" {
+			ns.Labels = map[string]string{"node-sidecar": label}
+		}
+		return ns
+	}
+	tests := []struct {
+		name        string
+		old, new    *core.Namespace
+		wantEnqueue bool
+	}{
+		{name: "labelled", old: namespace(""), new: namespace("true"), wantEnqueue: true},
+		{name: "disabled", old: namespace("true"), new: namespace("false"), wantEnqueue: true},
+		{name: "unlabelled", old: namespace("true"), new: namespace(""), wantEnqueue: true},
+		{name: "still enabled", old: namespace("true"), new: namespace("true")},
+		{name: "other value", old: namespace(""), new: namespace("yes")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enqueued := make(chan string, 1)
+			w := &namespaceWatch{
+				Enqueue: func(namespace string) error { enqueued <- namespace; return nil },
+				Log:     ctrl.Log.WithName("test"),
+			}
+			w.OnUpdate(tt.old, tt.new)
+			select {
+			case ns := <-enqueued:
+				if !tt.wantEnqueue || ns != "team" {
+					t.Errorf("enqueued %q, want nothing", ns)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantEnqueue {
+					t.Error("namespace not enqueued")
+				}
+			}
+		})
+	}
+}
+
+// subscriptions is an informer that only passes on its event handlers.
+type subscriptions chan toolscache.ResourceEventHandler
+
+func (s subscriptions) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	s <- handler
+}
+
+func TestNamespaceWatchStart(t *testing.T) {
+	informer := make(subscriptions, 1)
+	w := &namespaceWatch{Informer: informer, Log: ctrl.Log.WithName("test")}
+	select {
+	case <-informer:
+		t.Fatal("subscribed before being started")
+	default:
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- w.Start(stop) }()
+	select {
+	case handler := <-informer:
+		if handler != w {
+			t.Errorf("subscribed %v, want the watch", handler)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not subscribed once started")
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Start() = %v", err)
+	}
+}
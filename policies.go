@@ -0,0 +1,99 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	sidecarv1alpha1 "node-sidecar-injector/api/v1alpha1"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// policyFor returns the SidecarPolicy of dep's namespace selecting dep, or nil
+// if none does. When several do the first by name wins, so the choice doesn't
+// depend on the order the cache returns them in.
+func (a *MyReconciler) policyFor(dep *deployment) (*sidecarv1alpha1.SidecarPolicy, error) {
+	policies := &sidecarv1alpha1.SidecarPolicyList{}
+	if err := a.List(context.TODO(), policies, client.InNamespace(dep.Namespace)); err != nil {
+		return nil, err
+	}
+	sort.Slice(policies.Items, func(i, j int) bool { return policies.Items[i].Name < policies.Items[j].Name })
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.Selector)
+		if err != nil {
+			a.Log.Error(err, "ignoring sidecar policy with an invalid selector", "policy", types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name})
+			continue
+		}
+		if selector.Matches(labels.Set(dep.Labels)) {
+			return policy, nil
+		}
+	}
+	return nil, nil
+}
+
+// policySidecar returns the sidecar declared by policy, validated and
+// normalized like the one from -sidecar-config.
+func policySidecar(policy *sidecarv1alpha1.SidecarPolicy) (*core.Container, error) {
+	container := policy.Spec.Sidecar.DeepCopy()
+	if container.Name == "" {
+		container.Name = sidecarName
+	}
+	if errs := validateSidecarBase(container); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid SidecarPolicy %s/%s: %v", policy.Namespace, policy.Name, errs.ToAggregate())
+	}
+	normalizeSidecarBase(container)
+	return container, nil
+}
+
+// policyRequests maps an event for a SidecarPolicy to the Deployments of its
+// shard in the policy's namespace, as any of them may start or stop matching.
+func (a *MyReconciler) policyRequests(o handler.MapObject) []reconcile.Request {
+	deps, err := listDeployments(a, a.Config.PreferAppsV1, client.InNamespace(o.Meta.GetNamespace()))
+	return a.shardRequests(o, deps, err)
+}
+
+// policyReplicaSetRequests is policyRequests for the standalone ReplicaSets
+// with -inject-replicasets.
+func (a *MyReconciler) policyReplicaSetRequests(o handler.MapObject) []reconcile.Request {
+	sets, err := listReplicaSets(a, client.InNamespace(o.Meta.GetNamespace()))
+	return a.shardRequests(o, sets, err)
+}
+
+// shardRequests returns the requests for the objects of deps in the shard,
+// listed for the SidecarPolicy o, logging err when they couldn't be listed.
+func (a *MyReconciler) shardRequests(o handler.MapObject, deps []*deployment, err error) []reconcile.Request {
+	if err != nil {
+		a.Log.Error(err, "could not list objects for sidecar policy", "namespace", o.Meta.GetNamespace(), "policy", o.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, dep := range deps {
+		if dep.Name != "" && inShard(dep.UID, a.Config.ShardIndex, a.Config.ShardCount) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: dep.Namespace, Name: dep.Name}})
+		}
+	}
+	return requests
+}
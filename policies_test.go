@@ -0,0 +1,95 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	sidecarv1alpha1 "node-sidecar-injector/api/v1alpha1"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// testPolicy returns a SidecarPolicy in namespace default running image for
+// the Deployments labelled tier.
+func testPolicy(name, tier, image string) *sidecarv1alpha1.SidecarPolicy {
+	return &sidecarv1alpha1.SidecarPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: sidecarv1alpha1.SidecarPolicySpec{
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"tier": tier}},
+			Sidecar:  core.Container{Image: image},
+		},
+	}
+}
+
+func TestReconcilePolicy(t *testing.T) {
+	policy := testPolicy("mesh", "web", "mesh:1")
+	a := testReconciler(testConfig(t, "-enable-policies", "-remove-on-opt-out"), policy,
+		testDeployment("web", map[string]string{"tier": "web"}),
+		testDeployment("api", map[string]string{"tier": "api", "node-sidecar": "true"}),
+	)
+	image := func(name string) string {
+		t.Helper()
+		if _, err := a.Reconcile(request(name)); err != nil {
+			t.Fatal(err)
+		}
+		spec := &stored(t, a.Client, name).Template.Spec
+		if i := sidecarIndex(spec); i >= 0 {
+			return spec.Containers[i].Image
+		}
+		return ""
+	}
+
+	if got := image("web"); got != "mesh:1" {
+		t.Errorf("selected deployment got sidecar %q, want the policy's mesh:1", got)
+	}
+	if got := image("api"); got != "" {
+		t.Errorf("deployment outside the policy got sidecar %q, want none", got)
+	}
+
+	policy.Spec.Sidecar.Image = "mesh:2"
+	if err := a.Update(context.TODO(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if got := image("web"); got != "mesh:2" {
+		t.Errorf("after editing the policy's sidecar got %q, want mesh:2", got)
+	}
+
+	policy.Spec.Selector.MatchLabels["tier"] = "api"
+	if err := a.Update(context.TODO(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if got := image("web"); got != "" {
+		t.Errorf("deployment no longer selected kept sidecar %q", got)
+	}
+	if got := image("api"); got != "mesh:2" {
+		t.Errorf("newly selected deployment got sidecar %q, want mesh:2", got)
+	}
+}
+
+func TestPolicyRequests(t *testing.T) {
+	other := testDeployment("elsewhere", nil)
+	other.Namespace = "other"
+	a := testReconciler(testConfig(t, "-enable-policies"), testDeployment("web", nil), testDeployment("api", nil), other)
+	policy := testPolicy("mesh", "web", "mesh:1")
+	requests := a.policyRequests(handler.MapObject{Meta: policy, Object: policy})
+	if len(requests) != 2 || requests[0] != request("api") && requests[1] != request("api") {
+		t.Errorf("policyRequests() = %v, want every deployment in default", requests)
+	}
+}
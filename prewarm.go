@@ -0,0 +1,75 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	core "k8s.io/api/core/v1"
+)
+
+// prewarmName is the init container pulling the sidecar image before the app
+// containers start.
+const prewarmName = "node-sidecar-prewarm"
+
+// defaultPrewarmCommand exits right away, the init container only exists to
+// have the image on the node.
+var defaultPrewarmCommand = []string{"/bin/sh", "-c", "true"}
+
+// prewarmContainer returns the init container pre-warming the image of
+// sidecar, running command or defaultPrewarmCommand when command is empty.
+func prewarmContainer(sidecar core.Container, command []string) core.Container {
+	if len(command) == 0 {
+		command = defaultPrewarmCommand
+	}
+	return core.Container{
+		Name:            prewarmName,
+		Image:           sidecar.Image,
+		ImagePullPolicy: sidecar.ImagePullPolicy,
+		Command:         command,
+		Resources:       sidecar.Resources,
+		SecurityContext: sidecar.SecurityContext,
+	}
+}
+
+// injectPrewarm adds the prewarm init container to spec, or replaces it when
+// it drifted from prewarm, e.g. the sidecar resources changed. It reports
+// whether spec changed.
+func injectPrewarm(spec *core.PodSpec, prewarm core.Container) bool {
+	for i := range spec.InitContainers {
+		container := &spec.InitContainers[i]
+		if container.Name != prewarmName {
+			continue
+		}
+		if !drifted(*container, prewarm) {
+			return false
+		}
+		*container = prewarm
+		return true
+	}
+	spec.InitContainers = append(spec.InitContainers, prewarm)
+	return true
+}
+
+// removePrewarm takes the prewarm init container out of spec again. It
+// reports whether spec changed.
+func removePrewarm(spec *core.PodSpec) bool {
+	for i, container := range spec.InitContainers {
+		if container.Name == prewarmName {
+			spec.InitContainers = append(spec.InitContainers[:i], spec.InitContainers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
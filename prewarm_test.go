@@ -0,0 +1,70 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestInjectPrewarm(t *testing.T) {
+	sidecar := sideCarContainer("node-demo:1")
+	sidecar.ImagePullPolicy = core.PullIfNotPresent
+	sidecar.Resources.Limits = core.ResourceList{core.ResourceCPU: resource.MustParse("100m")}
+	prewarm := prewarmContainer(sidecar, nil)
+	tests := []struct {
+		name string
+		live func(*core.Container)
+		want bool
+	}{
+		{name: "unchanged", live: func(*core.Container) {}, want: false},
+		{
+			name: "defaulted by the API server",
+			live: func(c *core.Container) { c.TerminationMessagePath = core.TerminationMessagePathDefault },
+			want: false,
+		},
+		{name: "image", live: func(c *core.Container) { c.Image = "node-demo:0" }, want: true},
+		{name: "command", live: func(c *core.Container) { c.Command = []string{"sleep", "1"} }, want: true},
+		{
+			name: "resources",
+			live: func(c *core.Container) {
+				c.Resources.Limits = core.ResourceList{core.ResourceCPU: resource.MustParse("50m")}
+			},
+			want: true,
+		},
+		{name: "pull policy", live: func(c *core.Container) { c.ImagePullPolicy = core.PullNever }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := prewarmContainer(sidecar, nil)
+			tt.live(&live)
+			spec := &core.PodSpec{InitContainers: []core.Container{live}, Containers: []core.Container{{Name: "app"}}}
+			if got := injectPrewarm(spec, prewarm); got != tt.want {
+				t.Errorf("injectPrewarm() = %v, want %v", got, tt.want)
+			}
+			if n := len(spec.InitContainers); n != 1 {
+				t.Errorf("got %d init containers, want the prewarm one", n)
+			}
+		})
+	}
+
+	spec := &core.PodSpec{Containers: []core.Container{{Name: "app"}}}
+	if !injectPrewarm(spec, prewarm) || len(spec.InitContainers) != 1 {
+		t.Errorf("prewarm container not added")
+	}
+}
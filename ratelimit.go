@@ -0,0 +1,74 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// objectLimiter keeps a token bucket per Deployment, so a Deployment another
+// controller keeps rewriting can't have the injector reconcile it in a loop.
+type objectLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[types.NamespacedName]*rate.Limiter
+}
+
+// newObjectLimiter returns a limiter allowing perSecond reconciles of every
+// Deployment, with bursts of burst. It lets everything through when perSecond
+// is 0.
+func newObjectLimiter(perSecond float64, burst int) *objectLimiter {
+	return &objectLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: map[types.NamespacedName]*rate.Limiter{},
+	}
+}
+
+// delay takes a token for reconciling key. It returns 0 when one was left, or
+// how long to wait for the next one otherwise.
+func (l *objectLimiter) delay(key types.NamespacedName) time.Duration {
+	if l.limit == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, found := l.limiters[key]
+	if !found {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[key] = limiter
+	}
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		// the requeued reconcile takes its own token
+		reservation.Cancel()
+	}
+	return delay
+}
+
+// forget drops the bucket of the deleted Deployment key.
+func (l *objectLimiter) forget(key types.NamespacedName) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.limiters, key)
+}
@@ -0,0 +1,54 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestObjectLimiter(t *testing.T) {
+	web := types.NamespacedName{Namespace: "default", Name: "web"}
+	api := types.NamespacedName{Namespace: "default", Name: "api"}
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     int
+		calls     int
+		wantDelay []bool
+	}{
+		{name: "unlimited", perSecond: 0, burst: 1, calls: 3, wantDelay: []bool{false, false, false}},
+		{name: "burst used up", perSecond: 0.01, burst: 2, calls: 4, wantDelay: []bool{false, false, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newObjectLimiter(tt.perSecond, tt.burst)
+			for i := 0; i < tt.calls; i++ {
+				if got := l.delay(web) > 0; got != tt.wantDelay[i] {
+					t.Errorf("call %d delayed = %v, want %v", i+1, got, tt.wantDelay[i])
+				}
+			}
+			if l.delay(api) > 0 {
+				t.Errorf("another deployment was delayed")
+			}
+			l.forget(web)
+			if l.delay(web) > 0 {
+				t.Errorf("forgotten deployment was delayed")
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	// readinessVolumeName is the emptyDir the app containers signal their
+	// readiness to the sidecar through with -couple-readiness.
+	readinessVolumeName = "node-sidecar-readiness"
+	// readinessMarker is the file the app writes into the readiness volume
+	// once it is ready.
+	readinessMarker = "ready"
+)
+
+// readinessProbe returns the probe keeping the sidecar unready until the app
+// wrote the marker into the readiness volume mounted at dir.
+func readinessProbe(dir string) *core.Probe {
+	return &core.Probe{
+		Handler: core.Handler{Exec: &core.ExecAction{
+			Command: []string{"test", "-f", path.Join(dir, readinessMarker)},
+		}},
+		PeriodSeconds: 2,
+	}
+}
+
+// injectReadinessVolume wires the readiness volume into spec. It reports
+// whether spec changed.
+func injectReadinessVolume(spec *core.PodSpec, dir, primary string) bool {
+	return injectSharedVolume(spec, readinessVolumeName, dir, primary)
+}
+
+// removeReadinessVolume takes the readiness volume and its mounts out of spec
+// again. It reports whether spec changed.
+func removeReadinessVolume(spec *core.PodSpec) bool {
+	return removeSharedVolume(spec, readinessVolumeName)
+}
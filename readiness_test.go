@@ -0,0 +1,61 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+)
+
+func TestInjectReadinessVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantMounted []string
+	}{
+		{name: "all app containers", args: []string{"-couple-readiness"}, wantMounted: []string{"app", "worker", sidecarName}},
+		{name: "primary container", args: []string{"-couple-readiness", "-primary-container=worker"}, wantMounted: []string{"worker", sidecarName}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			obj := testDeployment("web", nil)
+			obj.Spec.Template.Spec.Containers = append(obj.Spec.Template.Spec.Containers, core.Container{Name: "worker", Image: "worker:1"})
+			dep := asDeployment(obj)
+			sidecar, err := a.desiredSidecar(dep, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !a.inject(dep, sidecar) {
+				t.Fatal("sidecar not injected")
+			}
+			spec := &dep.Template.Spec
+			if got := mountedIn(spec, readinessVolumeName); !equalStrings(got, tt.wantMounted) {
+				t.Errorf("mounted in %q, want %q", got, tt.wantMounted)
+			}
+			probe := spec.Containers[sidecarIndex(spec)].ReadinessProbe
+			marker := path.Join(a.Config.CoupleReadinessPath, readinessMarker)
+			if probe == nil || probe.Exec == nil || probe.Exec.Command[len(probe.Exec.Command)-1] != marker {
+				t.Errorf("sidecar readiness probe = %+v, want one testing for %s", probe, marker)
+			}
+			if a.inject(dep, sidecar) {
+				t.Errorf("injecting again changed the deployment")
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// registryClient looks up images in their registry.
+type registryClient interface {
+	// ManifestExists reports whether the registry has a manifest for image,
+	// authenticating with credentials when the registry asks for them.
+	ManifestExists(image string, credentials credentials) (bool, error)
+}
+
+// credentials returns the user and password for a registry host, or empty
+// strings for anonymous access.
+type credentials func(host string) (string, string)
+
+// How long an image that couldn't be found is not looked up again: a registry
+// that answered it doesn't have the image is asked again after verifyRetry,
+// one that couldn't be asked after verifyErrorRetry.
+const (
+	verifyRetry      = time.Minute
+	verifyErrorRetry = 10 * time.Second
+)
+
+// imageVerifier gates injection on the sidecar image being in its registry,
+// so a typo in the image or tag doesn't roll out pods that can't pull it.
+// Images are looked up with the pull secrets of the Deployment, read with
+// Reader.
+type imageVerifier struct {
+	Registry registryClient
+	Reader   client.Reader
+	Log      logr.Logger
+
+	mu      sync.Mutex
+	checked map[string]verification
+}
+
+type verification struct {
+	found bool
+	next  time.Time
+}
+
+func newImageVerifier(registry registryClient, reader client.Reader) *imageVerifier {
+	return &imageVerifier{Registry: registry, Reader: reader, checked: map[string]verification{}}
+}
+
+// verificationKey identifies the lookup of image with the pull secrets of
+// dep. Deployments without pull secrets share the anonymous lookup.
+func verificationKey(dep *deployment, image string) string {
+	secrets := dep.Template.Spec.ImagePullSecrets
+	if len(secrets) == 0 {
+		return image
+	}
+	var names []string
+	for _, secret := range secrets {
+		names = append(names, secret.Name)
+	}
+	return image + " " + dep.Namespace + "/" + strings.Join(names, ",")
+}
+
+// exists reports whether image was found in its registry with the pull
+// secrets of dep. Found images are remembered, missing ones are looked up
+// again after verifyRetry, or verifyErrorRetry if the registry couldn't be
+// asked.
+func (v *imageVerifier) exists(dep *deployment, image string) bool {
+	key := verificationKey(dep, image)
+	v.mu.Lock()
+	last, ok := v.checked[key]
+	v.mu.Unlock()
+	if ok && (last.found || time.Now().Before(last.next)) {
+		return last.found
+	}
+
+	// not holding the lock, a slow registry mustn't stall other reconciles
+	found := false
+	credentials, err := pullSecretCredentials(v.Reader, dep.Namespace, dep.Template.Spec.ImagePullSecrets)
+	if err == nil {
+		found, err = v.Registry.ManifestExists(image, credentials)
+	}
+	retry := verifyRetry
+	switch {
+	case err != nil:
+		v.Log.Error(err, "could not verify sidecar image, not injecting it", "image", image, "namespace", dep.Namespace)
+		retry = verifyErrorRetry
+	case !found:
+		v.Log.Info("sidecar image not found, not injecting it", "image", image, "namespace", dep.Namespace)
+	default:
+		v.Log.Info("verified sidecar image", "image", image, "namespace", dep.Namespace)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.checked[key] = verification{found: found, next: time.Now().Add(retry)}
+	return found
+}
+
+// retryIn returns how long until image is looked up again for dep, for
+// requeueing a Deployment skipped because it wasn't found.
+func (v *imageVerifier) retryIn(dep *deployment, image string) time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if wait := time.Until(v.checked[verificationKey(dep, image)].next); wait > time.Second {
+		return wait
+	}
+	return time.Second
+}
+
+// dockerHub is the registry of images without a registry host.
+const dockerHub = "registry-1.docker.io"
+
+// httpRegistry talks to registries implementing the Docker registry v2 API.
+type httpRegistry struct {
+	Client *http.Client
+}
+
+// ManifestExists implements registryClient with a HEAD request for the
+// manifest, answering a bearer token challenge if the registry sends one.
+func (r *httpRegistry) ManifestExists(image string, credentials credentials) (bool, error) {
+	host, repository, reference := parseImage(image)
+	manifest := "https://" + host + "/v2/" + repository + "/manifests/" + reference
+	resp, err := r.head(manifest, "")
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := r.authorize(host, resp.Header.Get("Www-Authenticate"), credentials)
+		if err != nil {
+			return false, err
+		}
+		if resp, err = r.head(manifest, authorization); err != nil {
+			return false, err
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("registry returned %s for %s", resp.Status, image)
+	}
+}
+
+func (r *httpRegistry) head(url, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.index.v1+json",
+	}, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authorize answers the challenge of host with credentials, returning the
+// Authorization header to retry with.
+func (r *httpRegistry) authorize(host, challenge string, credentials credentials) (string, error) {
+	user, password := credentials(host)
+	if strings.HasPrefix(challenge, "Basic") {
+		if user == "" {
+			return "", fmt.Errorf("registry %s needs credentials", host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+	}
+	if !strings.HasPrefix(challenge, "Bearer") {
+		return "", fmt.Errorf("unsupported challenge %q from registry %s", challenge, host)
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("challenge from registry %s has no realm", host)
+	}
+	query := url.Values{}
+	for _, name := range []string{"service", "scope"} {
+		if params[name] != "" {
+			query.Set(name, params[name])
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint of registry %s returned %s", host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseImage splits image into its registry host, repository and tag or
+// digest, applying the Docker Hub defaults.
+func parseImage(image string) (host, repository, reference string) {
+	reference = "latest"
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, reference = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, reference = image[:i], image[i+1:]
+	}
+	host = dockerHub
+	if i := strings.Index(image, "/"); i >= 0 && (strings.ContainsAny(image[:i], ".:") || image[:i] == "localhost") {
+		host, image = image[:i], image[i+1:]
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		host = dockerHub
+	}
+	if host == dockerHub && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return host, image, reference
+}
+
+// pullSecretCredentials reads the dockerconfigjson pull secrets of namespace
+// and returns the credentials they hold per registry host. Like the kubelet,
+// the first secret with credentials for a host wins and missing secrets are
+// ignored.
+func pullSecretCredentials(reader client.Reader, namespace string, secrets []core.LocalObjectReference) (credentials, error) {
+	byHost := map[string][2]string{}
+	for i := len(secrets) - 1; i >= 0; i-- {
+		key := types.NamespacedName{Namespace: namespace, Name: secrets[i].Name}
+		secret := &core.Secret{}
+		if err := reader.Get(context.TODO(), key, secret); apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var config struct {
+			Auths map[string]struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				Auth     string `json:"auth"`
+			} `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[core.DockerConfigJsonKey], &config); err != nil {
+			return nil, fmt.Errorf("invalid pull secret %s: %v", key, err)
+		}
+		for server, auth := range config.Auths {
+			user, password := auth.Username, auth.Password
+			if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil && auth.Auth != "" {
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) == 2 {
+					user, password = parts[0], parts[1]
+				}
+			}
+			// servers are written as hosts or as URLs like https://index.docker.io/v1/
+			host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+			host = strings.SplitN(host, "/", 2)[0]
+			if host == "docker.io" || host == "index.docker.io" {
+				host = dockerHub
+			}
+			// walking backwards, so earlier secrets overwrite later ones
+			byHost[host] = [2]string{user, password}
+		}
+	}
+	return func(host string) (string, string) {
+		c := byHost[host]
+		return c[0], c[1]
+	}, nil
+}
@@ -0,0 +1,128 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// stubRegistry answers lookups with found and err, recording the credentials
+// of every lookup.
+type stubRegistry struct {
+	found   bool
+	err     error
+	lookups int
+	user    string
+}
+
+func (r *stubRegistry) ManifestExists(image string, credentials credentials) (bool, error) {
+	r.lookups++
+	host, _, _ := parseImage(image)
+	r.user, _ = credentials(host)
+	return r.found, r.err
+}
+
+func TestImageVerifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		registry  *stubRegistry
+		wantFound bool
+		// wantRetry is the longest the next lookup is waited for
+		wantRetry time.Duration
+	}{
+		{name: "found", registry: &stubRegistry{found: true}, wantFound: true},
+		{name: "missing", registry: &stubRegistry{}, wantRetry: verifyRetry},
+		{name: "registry unreachable", registry: &stubRegistry{err: errors.New("timeout")}, wantRetry: verifyErrorRetry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newImageVerifier(tt.registry, fake.NewFakeClientWithScheme(scheme))
+			v.Log = ctrl.Log.WithName("test")
+			dep := asDeployment(testDeployment("web", nil))
+			for i := 0; i < 2; i++ {
+				if got := v.exists(dep, "node-demo:1"); got != tt.wantFound {
+					t.Errorf("exists() = %v, want %v", got, tt.wantFound)
+				}
+			}
+			if tt.registry.lookups != 1 {
+				t.Errorf("registry asked %d times, want the answer remembered", tt.registry.lookups)
+			}
+			if tt.wantRetry > 0 {
+				if retry := v.retryIn(dep, "node-demo:1"); retry > tt.wantRetry || retry < tt.wantRetry-time.Second {
+					t.Errorf("retryIn() = %v, want about %v", retry, tt.wantRetry)
+				}
+			}
+		})
+	}
+}
+
+func TestImageVerifierPullSecrets(t *testing.T) {
+	config, _ := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			"https://index.docker.io/v1/": map[string]string{"username": "robot", "password": "secret"},
+		},
+	})
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "hub"},
+		Type:       core.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{core.DockerConfigJsonKey: config},
+	}
+	registry := &stubRegistry{found: true}
+	v := newImageVerifier(registry, fake.NewFakeClientWithScheme(scheme, secret))
+	v.Log = ctrl.Log.WithName("test")
+
+	anonymous := asDeployment(testDeployment("anonymous", nil))
+	if !v.exists(anonymous, "node-demo:1") || registry.user != "" {
+		t.Errorf("anonymous lookup used credentials %q", registry.user)
+	}
+	obj := testDeployment("private", nil)
+	obj.Spec.Template.Spec.ImagePullSecrets = []core.LocalObjectReference{{Name: "missing"}, {Name: "hub"}}
+	if !v.exists(asDeployment(obj), "node-demo:1") || registry.user != "robot" {
+		t.Errorf("lookup with pull secrets used credentials %q, want robot", registry.user)
+	}
+	if registry.lookups != 2 {
+		t.Errorf("registry asked %d times, want a lookup per set of pull secrets", registry.lookups)
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image                           string
+		host, repository, wantReference string
+	}{
+		{image: "nginx", host: dockerHub, repository: "library/nginx", wantReference: "latest"},
+		{image: "aminmithil/node-demo:1.2", host: dockerHub, repository: "aminmithil/node-demo", wantReference: "1.2"},
+		{image: "docker.io/library/nginx:1", host: dockerHub, repository: "library/nginx", wantReference: "1"},
+		{image: "registry.example.com:5000/team/app:v2", host: "registry.example.com:5000", repository: "team/app", wantReference: "v2"},
+		{image: "localhost/app@sha256:abc", host: "localhost", repository: "app", wantReference: "sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			host, repository, reference := parseImage(tt.image)
+			if host != tt.host || repository != tt.repository || reference != tt.wantReference {
+				t.Errorf("parseImage() = %q, %q, %q, want %q, %q, %q", host, repository, reference, tt.host, tt.repository, tt.wantReference)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// replicaSetReconciler injects the sidecar into ReplicaSets with
+// -inject-replicasets, the same way MyReconciler does into Deployments.
+// ReplicaSets controlled by a Deployment are left to it: the Deployment
+// carries the sidecar into every ReplicaSet it creates, and a template it
+// didn't write would make it roll out a ReplicaSet of its own.
+type replicaSetReconciler struct {
+	*MyReconciler
+}
+
+// newReplicaSetReconciler returns a reconciler sharing everything with
+// deployments but the state kept per object, as a ReplicaSet may have the
+// name of a Deployment.
+func newReplicaSetReconciler(deployments *MyReconciler) *replicaSetReconciler {
+	r := *deployments
+	r.Log = deployments.Log.WithName("ReplicaSet")
+	r.Rollouts = newRolloutTracker(deployments.Rollouts.exemplars)
+	r.Denials = newAdmissionDenials()
+	r.Limiter = newObjectLimiter(deployments.Config.PerObjectRate, deployments.Config.PerObjectBurst)
+	return &replicaSetReconciler{&r}
+}
+
+// Reconcile injects the sidecar into the ReplicaSet, or removes it when the
+// ReplicaSet opted out, behind the same guards as Deployments. Only pods
+// created afterwards get the change, a ReplicaSet doesn't replace its running
+// pods.
+//
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch;update
+func (r *replicaSetReconciler) Reconcile(req reconcile.Request) (result reconcile.Result, err error) {
+	defer func() { r.Health.observe(err) }()
+	rs := &appsv1.ReplicaSet{}
+	inj, stop, result, err := r.reconcileSidecar(req, "replicaset", rs)
+	if stop {
+		return result, err
+	}
+	if !r.Config.DisablePerObjectMetrics {
+		lastReconcile.WithLabelValues("replicaset", req.Namespace, req.Name).SetToCurrentTime()
+	}
+	return r.retryUnverified(asDeployment(rs), &inj), nil
+}
+
+// standaloneReplicaSets only lets through events for ReplicaSets that aren't
+// controlled by a Deployment, and every delete so what was kept about a
+// deleted ReplicaSet is dropped.
+var standaloneReplicaSets = predicate.Funcs{
+	CreateFunc:  func(e event.CreateEvent) bool { return standalone(e.Meta) },
+	DeleteFunc:  func(e event.DeleteEvent) bool { return true },
+	UpdateFunc:  func(e event.UpdateEvent) bool { return standalone(e.MetaNew) },
+	GenericFunc: func(e event.GenericEvent) bool { return standalone(e.Meta) },
+}
+
+// standalone reports whether the ReplicaSet meta isn't controlled by a
+// Deployment.
+func standalone(meta metav1.Object) bool {
+	owner := metav1.GetControllerOf(meta)
+	return owner == nil || owner.Kind != "Deployment"
+}
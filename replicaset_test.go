@@ -0,0 +1,160 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	sidecarv1alpha1 "node-sidecar-injector/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// testReplicaSet returns a ReplicaSet in namespace default labelled labels,
+// controlled by the Deployment owner unless it is empty.
+func testReplicaSet(name, owner string, labels map[string]string) *appsv1.ReplicaSet {
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Spec: appsv1.ReplicaSetSpec{
+			Template: testDeployment(name, nil).Spec.Template,
+		},
+	}
+	if owner != "" {
+		controller := true
+		rs.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: owner, UID: "deployment-uid", Controller: &controller}}
+	}
+	return rs
+}
+
+// storedReplicaSet returns the stored ReplicaSet name, failing t if it can't
+// be read.
+func storedReplicaSet(t *testing.T, a *MyReconciler, name string) *deployment {
+	t.Helper()
+	rs := &appsv1.ReplicaSet{}
+	if err := a.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, rs); err != nil {
+		t.Fatalf("get replicaset %s: %v", name, err)
+	}
+	return asDeployment(rs)
+}
+
+func TestReplicaSetReconcile(t *testing.T) {
+	opted := map[string]string{"node-sidecar": "true"}
+	tests := []struct {
+		name         string
+		rs           *appsv1.ReplicaSet
+		wantInjected bool
+	}{
+		{name: "standalone", rs: testReplicaSet("batch", "", opted), wantInjected: true},
+		{name: "standalone, not opted in", rs: testReplicaSet("batch", "", nil)},
+		{name: "owned by a deployment", rs: testReplicaSet("batch", "web", opted)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReplicaSetReconciler(testReconciler(testConfig(t, "-inject-replicasets"), tt.rs))
+			if _, err := r.Reconcile(request("batch")); err != nil {
+				t.Fatal(err)
+			}
+			rs := storedReplicaSet(t, r.MyReconciler, "batch")
+			if got := sidecarIndex(&rs.Template.Spec) >= 0; got != tt.wantInjected {
+				t.Errorf("sidecar injected = %v, want %v", got, tt.wantInjected)
+			}
+			if _, found := rs.Labels["pod-count"]; found {
+				t.Errorf("pod count written to a replicaset")
+			}
+		})
+	}
+}
+
+func TestReplicaSetKeptApartFromDeployment(t *testing.T) {
+	audit, path, cleanup := testAuditLog(t, 0)
+	defer cleanup()
+
+	opted := map[string]string{"node-sidecar": "true"}
+	a := testReconciler(testConfig(t, "-inject-replicasets"), testDeployment("web", opted), testReplicaSet("web", "", opted))
+	a.AuditLog = audit
+	r := newReplicaSetReconciler(a)
+	for _, run := range []func() error{
+		func() error { _, err := a.Reconcile(request("web")); return err },
+		func() error { _, err := r.Reconcile(request("web")); return err },
+	} {
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the ReplicaSet goes, the Deployment of the same name stays
+	if err := a.Delete(context.TODO(), testReplicaSet("web", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !standaloneReplicaSets.Delete(event.DeleteEvent{Meta: &testReplicaSet("web", "", nil).ObjectMeta}) {
+		t.Fatal("replicaset delete filtered out")
+	}
+	if _, err := r.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := audit.last[auditKey{"deployment", request("web").NamespacedName}]; !found {
+		t.Errorf("deleting the replicaset forgot the deployment's audit state")
+	}
+	if _, found := audit.last[auditKey{"replicaset", request("web").NamespacedName}]; found {
+		t.Errorf("audit state of the deleted replicaset kept")
+	}
+
+	var kinds []string
+	for _, record := range readAudit(t, path) {
+		kinds = append(kinds, record.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != "deployment" || kinds[1] != "replicaset" {
+		t.Errorf("audit records of kinds %q, want one of the deployment and one of the replicaset", kinds)
+	}
+}
+
+func TestEnqueueReplicaSets(t *testing.T) {
+	opted := map[string]string{"node-sidecar": "true"}
+	deployments, replicaSets := make(chan event.GenericEvent, 10), make(chan event.GenericEvent, 10)
+	a := testReconciler(testConfig(t, "-inject-replicasets"),
+		testDeployment("web", opted),
+		testReplicaSet("web-5d8f", "web", opted),
+		testReplicaSet("batch", "", opted),
+		testReplicaSet("other", "", nil),
+	)
+	a.Events, a.ReplicaSetEvents = deployments, replicaSets
+	if err := a.enqueueInjected(); err != nil {
+		t.Fatal(err)
+	}
+	if got := enqueued(deployments); len(got) != 1 || got[0] != "web" {
+		t.Errorf("enqueued deployments %q, want web", got)
+	}
+	if got := enqueued(replicaSets); len(got) != 1 || got[0] != "batch" {
+		t.Errorf("enqueued replicasets %q, want batch", got)
+	}
+}
+
+func TestPolicyReplicaSetRequests(t *testing.T) {
+	a := testReconciler(testConfig(t, "-inject-replicasets", "-enable-policies"),
+		testReplicaSet("web-5d8f", "web", nil),
+		testReplicaSet("batch", "", nil),
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "elsewhere"}},
+	)
+	policy := &sidecarv1alpha1.SidecarPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "policy"}}
+	requests := a.policyReplicaSetRequests(handler.MapObject{Meta: policy, Object: policy})
+	if len(requests) != 1 || requests[0] != request("batch") {
+		t.Errorf("policyReplicaSetRequests() = %v, want batch", requests)
+	}
+}
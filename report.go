@@ -0,0 +1,87 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// fleetReport summarises what the injector would do with every Deployment of
+// its shard.
+type fleetReport struct {
+	WouldInject     int            `json:"wouldInject"`
+	AlreadyInjected int            `json:"alreadyInjected"`
+	WouldRemove     int            `json:"wouldRemove"`
+	Skipped         map[string]int `json:"skipped"`
+}
+
+// report evaluates every Deployment without changing any of them.
+func (a *MyReconciler) report() (*fleetReport, error) {
+	if a.ImageChannel != nil && a.ImageChannel.Tag() == "" {
+		// the channel isn't started for a report, without the tag every
+		// injected Deployment would look outdated
+		if err := a.ImageChannel.refresh(); err != nil {
+			return nil, fmt.Errorf("could not read the image channel: %v", err)
+		}
+	}
+	deps, err := listDeployments(a, a.Config.PreferAppsV1)
+	if err != nil {
+		return nil, err
+	}
+	r := &fleetReport{Skipped: map[string]int{}}
+	for _, dep := range deps {
+		if !inShard(dep.UID, a.Config.ShardIndex, a.Config.ShardCount) {
+			continue
+		}
+		if paused(dep) {
+			r.Skipped[skipPaused]++
+			continue
+		}
+		sidecar, reason, _ := a.evaluate(dep)
+		switch {
+		case reason == skipSelectorMismatch && a.Config.RemoveOnOptOut && a.remove(asDeployment(dep.Object.DeepCopyObject())):
+			r.WouldRemove++
+		case reason != "":
+			r.Skipped[reason]++
+		case a.inject(asDeployment(dep.Object.DeepCopyObject()), sidecar):
+			r.WouldInject++
+		default:
+			r.AlreadyInjected++
+		}
+	}
+	return r, nil
+}
+
+// writeTable prints r as a table, one skip reason per line.
+func (r *fleetReport) writeTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DECISION\tREASON\tDEPLOYMENTS")
+	fmt.Fprintf(w, "would-inject\t\t%d\n", r.WouldInject)
+	fmt.Fprintf(w, "already-injected\t\t%d\n", r.AlreadyInjected)
+	fmt.Fprintf(w, "would-remove\t\t%d\n", r.WouldRemove)
+	var reasons []string
+	for reason := range r.Skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "skipped\t%s\t%d\n", reason, r.Skipped[reason])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReport(t *testing.T) {
+	opted := map[string]string{"node-sidecar": "true"}
+	tests := []struct {
+		name string
+		args []string
+		want fleetReport
+	}{
+		{name: "sidecar kept on opt-out", want: fleetReport{
+			WouldInject: 1, AlreadyInjected: 1,
+			Skipped: map[string]int{skipSelectorMismatch: 2, skipPaused: 1},
+		}},
+		{name: "sidecar removed on opt-out", args: []string{"-remove-on-opt-out"}, want: fleetReport{
+			WouldInject: 1, AlreadyInjected: 1, WouldRemove: 1,
+			Skipped: map[string]int{skipSelectorMismatch: 1, skipPaused: 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paused := testDeployment("paused", opted)
+			paused.Annotations = map[string]string{pausedAnnotation: "true"}
+			a := testReconciler(testConfig(t, tt.args...),
+				testDeployment("new", opted),
+				testDeployment("done", opted),
+				testDeployment("left", opted),
+				testDeployment("plain", nil),
+				paused,
+			)
+			for _, name := range []string{"done", "left"} {
+				if _, err := a.Reconcile(request(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			left := stored(t, a.Client, "left")
+			delete(left.Labels, "node-sidecar")
+			if err := a.Update(context.TODO(), left.Object); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := a.report()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("report() = %+v, want %+v", *got, tt.want)
+			}
+			if sidecarIndex(&stored(t, a.Client, "new").Template.Spec) >= 0 {
+				t.Error("report injected the sidecar")
+			}
+		})
+	}
+}
+
+func TestReportReadsImageChannel(t *testing.T) {
+	const source = "configmap:ops/sidecar/tag"
+	cm := &core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "sidecar"},
+		Data:       map[string]string{"tag": "2.0"},
+	}
+	cfg := testConfig(t, "-image-channel="+source)
+	a := testReconciler(cfg, cm, testDeployment("done", map[string]string{"node-sidecar": "true"}))
+	a.ImageChannel, _ = newImageChannel(source, cfg.ImageChannelInterval.Duration)
+	a.ImageChannel.Reader = a.Client
+	if err := a.ImageChannel.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reconcile(request("done")); err != nil {
+		t.Fatal(err)
+	}
+
+	// as started for -report, the channel wasn't read yet
+	a.ImageChannel, _ = newImageChannel(source, cfg.ImageChannelInterval.Duration)
+	a.ImageChannel.Reader = a.Client
+	got, err := a.report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (fleetReport{AlreadyInjected: 1, Skipped: map[string]int{}}); !reflect.DeepEqual(*got, want) {
+		t.Errorf("report() = %+v, want %+v", *got, want)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// replicaScaling sizes one sidecar resource by the replica count of the
+// Deployment, as Base + Step * replicas clamped to Min and Max.
+type replicaScaling struct {
+	Resource   core.ResourceName
+	Base, Step resource.Quantity
+	Min, Max   *resource.Quantity
+}
+
+// parseReplicaScaling parses the comma separated -replica-scaled-resources
+// rules, each written as <resource>=[<base>+]<step>*replicas[:<min>[:<max>]],
+// e.g. memory=64Mi+8Mi*replicas:64Mi:1Gi.
+func parseReplicaScaling(value string) ([]replicaScaling, error) {
+	var rules []replicaScaling
+	for _, text := range strings.Split(value, ",") {
+		if text == "" {
+			continue
+		}
+		eq := strings.Index(text, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("%q must look like <resource>=[<base>+]<step>*replicas[:<min>[:<max>]]", text)
+		}
+		rule := replicaScaling{Resource: core.ResourceName(text[:eq])}
+		parts := strings.Split(text[eq+1:], ":")
+		if len(parts) > 3 || !strings.HasSuffix(parts[0], "*replicas") {
+			return nil, fmt.Errorf("%q must look like <resource>=[<base>+]<step>*replicas[:<min>[:<max>]]", text)
+		}
+		formula := strings.TrimSuffix(parts[0], "*replicas")
+		step := formula
+		if plus := strings.Index(formula, "+"); plus >= 0 {
+			base, err := resource.ParseQuantity(formula[:plus])
+			if err != nil {
+				return nil, fmt.Errorf("invalid base in %q: %v", text, err)
+			}
+			rule.Base, step = base, formula[plus+1:]
+		}
+		var err error
+		if rule.Step, err = resource.ParseQuantity(step); err != nil {
+			return nil, fmt.Errorf("invalid step in %q: %v", text, err)
+		}
+		for i, bound := range []**resource.Quantity{&rule.Min, &rule.Max} {
+			if len(parts) <= i+1 || parts[i+1] == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(parts[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid bound in %q: %v", text, err)
+			}
+			*bound = &quantity
+		}
+		if rule.Min != nil && rule.Max != nil && rule.Min.Cmp(*rule.Max) > 0 {
+			return nil, fmt.Errorf("minimum of %q is above its maximum", text)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// quantity returns the resource for a Deployment of replicas.
+func (s replicaScaling) quantity(replicas int32) resource.Quantity {
+	milli := s.Base.MilliValue() + s.Step.MilliValue()*int64(replicas)
+	quantity := *resource.NewMilliQuantity(milli, s.Step.Format)
+	if milli%1000 == 0 {
+		// memory in whole bytes reads better without the milli suffix
+		quantity = *resource.NewQuantity(milli/1000, s.Step.Format)
+	}
+	if s.Min != nil && quantity.Cmp(*s.Min) < 0 {
+		quantity = s.Min.DeepCopy()
+	}
+	if s.Max != nil && quantity.Cmp(*s.Max) > 0 {
+		quantity = s.Max.DeepCopy()
+	}
+	return quantity
+}
+
+// scaleResources sets the requests of resources by rules for a Deployment of
+// replicas. Limits below a scaled request are raised to it, the API server
+// rejects them otherwise.
+func scaleResources(resources *core.ResourceRequirements, rules []replicaScaling, replicas int32) {
+	for _, rule := range rules {
+		quantity := rule.quantity(replicas)
+		if resources.Requests == nil {
+			resources.Requests = core.ResourceList{}
+		}
+		resources.Requests[rule.Resource] = quantity
+		if limit, found := resources.Limits[rule.Resource]; found && limit.Cmp(quantity) < 0 {
+			resources.Limits[rule.Resource] = quantity
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestParseReplicaScaling(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+		// want is the quantity of the first rule by replicas
+		want map[int32]string
+	}{
+		{value: "memory=64Mi+8Mi*replicas:64Mi:1Gi", want: map[int32]string{0: "64Mi", 4: "96Mi", 1000: "1Gi"}},
+		{value: "cpu=50m*replicas:100m", want: map[int32]string{1: "100m", 4: "200m"}},
+		{value: "cpu=1*replicas", want: map[int32]string{3: "3"}},
+		{value: ""},
+		{value: "memory", wantErr: true},
+		{value: "memory=8Mi", wantErr: true},
+		{value: "memory=x*replicas", wantErr: true},
+		{value: "memory=8Mi*replicas:1Gi:64Mi", wantErr: true},
+		{value: "memory=8Mi*replicas:1:2:3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			rules, err := parseReplicaScaling(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplicaScaling() error = %v, want error %v", err, tt.wantErr)
+			}
+			for replicas, want := range tt.want {
+				if got := rules[0].quantity(replicas); got.String() != want {
+					t.Errorf("quantity(%d) = %s, want %s", replicas, got.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// selfDeployment finds the Deployment the injector runs in, by following the
+// owners of its own pod, named by $POD_NAMESPACE and $POD_NAME from the
+// downward API. It returns an empty name when the injector doesn't run in a
+// Deployment.
+func selfDeployment(reader client.Reader) (types.NamespacedName, error) {
+	namespace, name := os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME")
+	if namespace == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("POD_NAMESPACE and POD_NAME must be set to find the injector's own Deployment")
+	}
+	pod := &core.Pod{}
+	if err := reader.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, pod); err != nil {
+		return types.NamespacedName{}, err
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return types.NamespacedName{}, nil
+	}
+	rs := &appsv1.ReplicaSet{}
+	if err := reader.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: owner.Name}, rs); err != nil {
+		return types.NamespacedName{}, err
+	}
+	owner = metav1.GetControllerOf(rs)
+	if owner == nil || owner.Kind != "Deployment" {
+		return types.NamespacedName{}, nil
+	}
+	return types.NamespacedName{Namespace: namespace, Name: owner.Name}, nil
+}
@@ -0,0 +1,105 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// setEnv sets the environment variables of env for the rest of the test,
+// unsetting the empty ones, and returns the func restoring them.
+func setEnv(env map[string]string) func() {
+	old := map[string]*string{}
+	for name, value := range env {
+		if v, found := os.LookupEnv(name); found {
+			old[name] = &v
+		} else {
+			old[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, value := range old {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func TestSelfDeployment(t *testing.T) {
+	controller := true
+	controlledBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+	objs := []runtime.Object{
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "injector-5d8f-x2k4z", OwnerReferences: controlledBy("ReplicaSet", "injector-5d8f")}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "injector-5d8f", OwnerReferences: controlledBy("Deployment", "injector")}},
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "injector-0", OwnerReferences: controlledBy("StatefulSet", "injector")}},
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "injector-batch", OwnerReferences: controlledBy("ReplicaSet", "batch")}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "batch"}},
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		pod       string
+		want      types.NamespacedName
+		wantErr   bool
+	}{
+		{name: "deployment", namespace: "ops", pod: "injector-5d8f-x2k4z", want: types.NamespacedName{Namespace: "ops", Name: "injector"}},
+		{name: "statefulset", namespace: "ops", pod: "injector-0"},
+		{name: "standalone replicaset", namespace: "ops", pod: "injector-batch"},
+		{name: "no downward API", wantErr: true},
+		{name: "pod not found", namespace: "ops", pod: "gone", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setEnv(map[string]string{"POD_NAMESPACE": tt.namespace, "POD_NAME": tt.pod})()
+			got, err := selfDeployment(fake.NewFakeClientWithScheme(scheme, objs...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selfDeployment() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selfDeployment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileSkipsSelf(t *testing.T) {
+	a := testReconciler(testConfig(t), testDeployment("injector", map[string]string{"node-sidecar": "true"}))
+	a.Self = request("injector").NamespacedName
+	if _, err := a.Reconcile(request("injector")); err != nil {
+		t.Fatal(err)
+	}
+	if dep := stored(t, a.Client, "injector"); sidecarIndex(&dep.Template.Spec) >= 0 {
+		t.Errorf("sidecar injected into the injector's own deployment")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	sidecarv1alpha1 "node-sidecar-injector/api/v1alpha1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// shardPredicate only lets through events for Deployments whose UID hashes to
+// shard index out of count. Events for Pods and SidecarPolicies all pass, they
+// are filtered once mapped to Deployments.
+func shardPredicate(index, count int) predicate.Funcs {
+	filter := func(meta metav1.Object, obj runtime.Object) bool {
+		switch obj.(type) {
+		case *core.Pod, *sidecarv1alpha1.SidecarPolicy:
+			// mapped to the Deployments of this shard later on
+			return true
+		}
+		return inShard(meta.GetUID(), index, count)
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return filter(e.Meta, e.Object) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return filter(e.Meta, e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return filter(e.MetaNew, e.ObjectNew) },
+		GenericFunc: func(e event.GenericEvent) bool { return filter(e.Meta, e.Object) },
+	}
+}
+
+// podRequests maps an event for a Pod to the Deployment controlling it, if
+// that Deployment is in the shard. Pods are controlled by a ReplicaSet, whose
+// controller is the Deployment, so the ReplicaSet is read from the cache to
+// find it.
+func (a *MyReconciler) podRequests(o handler.MapObject) []reconcile.Request {
+	owner := metav1.GetControllerOf(o.Meta)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return nil
+	}
+	rs := &appsv1.ReplicaSet{}
+	err := a.Get(context.TODO(), types.NamespacedName{Namespace: o.Meta.GetNamespace(), Name: owner.Name}, rs)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			a.Log.Error(err, "could not read replicaset of pod", "pod", types.NamespacedName{Namespace: o.Meta.GetNamespace(), Name: o.Meta.GetName()})
+		}
+		return nil
+	}
+	dep := metav1.GetControllerOf(rs)
+	if dep == nil || dep.Kind != "Deployment" || !inShard(dep.UID, a.Config.ShardIndex, a.Config.ShardCount) {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: rs.Namespace, Name: dep.Name}}}
+}
+
+// inShard reports whether uid belongs to shard index out of count.
+func inShard(uid types.UID, index, count int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+	return int(h.Sum32()%uint32(count)) == index
+}
+
+// shardLeaderElectionID gives every shard its own leader election lock, so
+// each shard has one active instance.
+func shardLeaderElectionID(index int) string {
+	return fmt.Sprintf("node-sidecar-injector-shard-%d", index)
+}
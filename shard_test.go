@@ -0,0 +1,103 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+func TestInShard(t *testing.T) {
+	const count = 3
+	for i := 0; i < 50; i++ {
+		uid := types.UID(fmt.Sprintf("uid-%d", i))
+		shards := 0
+		for index := 0; index < count; index++ {
+			if inShard(uid, index, count) {
+				shards++
+			}
+		}
+		if shards != 1 {
+			t.Errorf("%s is in %d shards, want exactly one", uid, shards)
+		}
+		if !inShard(uid, 0, 1) {
+			t.Errorf("%s is not in the only shard", uid)
+		}
+	}
+}
+
+func TestPodRequests(t *testing.T) {
+	controller := true
+	owned := func(kind, name string, uid types.UID) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, UID: uid, Controller: &controller}}
+	}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "web-5d8f", OwnerReferences: owned("Deployment", "web", "web-uid"),
+	}}
+	standalone := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "batch"}}
+
+	tests := []struct {
+		name   string
+		owners []metav1.OwnerReference
+		want   []string
+	}{
+		{name: "deployment pod", owners: owned("ReplicaSet", "web-5d8f", "rs-uid"), want: []string{"web"}},
+		{name: "standalone replicaset pod", owners: owned("ReplicaSet", "batch", "batch-uid")},
+		{name: "replicaset not cached", owners: owned("ReplicaSet", "gone", "gone-uid")},
+		{name: "statefulset pod", owners: owned("StatefulSet", "db", "db-uid")},
+		{name: "bare pod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t), rs, standalone)
+			pod := &core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", OwnerReferences: tt.owners}}
+			var got []string
+			for _, req := range a.podRequests(handler.MapObject{Meta: pod, Object: pod}) {
+				got = append(got, req.Name)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("podRequests() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodRequestsOtherShard(t *testing.T) {
+	controller := true
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "web-5d8f",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", UID: "web-uid", Controller: &controller}},
+	}}
+	pod := &core.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "pod",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: &controller}},
+	}}
+	mapped := 0
+	for index := 0; index < 3; index++ {
+		cfg := testConfig(t, "-shard-count=3", fmt.Sprintf("-shard-index=%d", index))
+		a := testReconciler(cfg, rs)
+		mapped += len(a.podRequests(handler.MapObject{Meta: pod, Object: pod}))
+	}
+	if mapped != 1 {
+		t.Errorf("pod mapped by %d shards, want exactly one", mapped)
+	}
+}
@@ -0,0 +1,478 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	sidecarName            = "node-sidecar"
+	sidecarHashAnnotation  = "node-sidecar/config-hash"
+	sidecarPort            = 8081
+	sidecarImageRepository = "aminmithil/node-demo"
+	defaultSidecarImageTag = "latest"
+)
+
+// sidecarImage returns the image to inject, using the tag from the image
+// channel once one has been read.
+func (a *MyReconciler) sidecarImage() string {
+	tag := defaultSidecarImageTag
+	if a.ImageChannel != nil && a.ImageChannel.Tag() != "" {
+		tag = a.ImageChannel.Tag()
+	}
+	return sidecarImageRepository + ":" + tag
+}
+
+// templateData is what the sidecar command and args templates are rendered
+// with, e.g. {{ .Namespace }} or {{ index .Labels "app" }}.
+type templateData struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// sidecarBase returns the container the sidecar of dep is built from instead
+// of the built-in one: the sidecar of the SidecarPolicy selecting dep, or the
+// one from -sidecar-config. It returns nil if there is none.
+func (a *MyReconciler) sidecarBase(dep *deployment) (*core.Container, error) {
+	if a.Config.EnablePolicies {
+		policy, err := a.policyFor(dep)
+		if err != nil || policy == nil {
+			return nil, err
+		}
+		return policySidecar(policy)
+	}
+	if a.Config.SidecarBase != nil {
+		return a.Config.SidecarBase.DeepCopy(), nil
+	}
+	return nil, nil
+}
+
+// desiredSidecar returns the sidecar container as it should run in dep, built
+// from base when it isn't nil.
+func (a *MyReconciler) desiredSidecar(dep *deployment, base *core.Container) (core.Container, error) {
+	sidecar := sideCarContainer(a.sidecarImage())
+	if base != nil {
+		sidecar = *base
+	}
+	if a.Config.SidecarImagePullPolicy != "" {
+		sidecar.ImagePullPolicy = core.PullPolicy(a.Config.SidecarImagePullPolicy)
+	}
+	// validated at startup
+	resources, _ := a.Config.sidecarResources()
+	if ratio := a.Config.SidecarResourceRatio; ratio > 0 {
+		if primary := primaryContainer(&dep.Template.Spec, a.Config.PrimaryContainer); primary != nil {
+			resources = mergeResources(proportionalResources(primary.Resources, ratio, a.Config.SidecarRequestsOnly), resources)
+		}
+	}
+	if len(resources.Requests) > 0 || len(resources.Limits) > 0 {
+		sidecar.Resources = resources
+	}
+	if rules, _ := parseReplicaScaling(a.Config.ReplicaScaledResources); len(rules) > 0 {
+		replicas := int32(1)
+		if dep.Replicas != nil {
+			replicas = *dep.Replicas
+		}
+		scaleResources(&sidecar.Resources, rules, replicas)
+	}
+	if ctx := a.Config.sidecarSecurityContext(); ctx != nil {
+		sidecar.SecurityContext = ctx
+	}
+
+	if dep.Template.Spec.HostNetwork {
+		// every container port of a host network pod is also a host port,
+		// declared so the scheduler keeps the pod off nodes where it's taken
+		for i := range sidecar.Ports {
+			sidecar.Ports[i].HostPort = sidecar.Ports[i].ContainerPort
+		}
+	}
+
+	// a readiness failure only takes the pod out of rotation, a liveness
+	// failure restarts the sidecar, so non-critical sidecars only get the
+	// former
+	if a.Config.SidecarTCPProbe && sidecar.ReadinessProbe == nil && len(sidecar.Ports) > 0 {
+		sidecar.ReadinessProbe = &core.Probe{
+			Handler: core.Handler{TCPSocket: &core.TCPSocketAction{Port: intstr.FromInt(int(sidecar.Ports[0].ContainerPort))}},
+		}
+	}
+	if !a.Config.SidecarCritical {
+		sidecar.LivenessProbe = nil
+	} else if sidecar.LivenessProbe == nil && sidecar.ReadinessProbe != nil {
+		sidecar.LivenessProbe = sidecar.ReadinessProbe.DeepCopy()
+	}
+	if sleep := a.Config.SidecarPreStopSleep.Duration; sleep > 0 {
+		// drain connections before the sidecar goes away
+		sidecar.Lifecycle = &core.Lifecycle{PreStop: &core.Handler{
+			Exec: &core.ExecAction{Command: []string{"sleep", strconv.FormatFloat(sleep.Seconds(), 'f', -1, 64)}},
+		}}
+	}
+
+	command, args := sidecar.Command, sidecar.Args
+	if len(a.Config.SidecarCommand) > 0 {
+		command = a.Config.SidecarCommand
+	}
+	if len(a.Config.SidecarArgs) > 0 {
+		args = a.Config.SidecarArgs
+	}
+	if a.Config.LogSidecar {
+		// ship the app logs from the shared volume instead
+		sidecar.Image = a.Config.LogSidecarImage
+		sidecar.Ports = nil
+		sidecar.ReadinessProbe, sidecar.LivenessProbe = nil, nil
+		sidecar.VolumeMounts = []core.VolumeMount{{Name: logVolumeName, MountPath: a.Config.LogSidecarPath}}
+		if len(a.Config.LogSidecarCommand) > 0 {
+			command = a.Config.LogSidecarCommand
+		}
+	}
+	if a.Config.CoupleReadiness {
+		// set after the liveness probe was copied, the sidecar must not be
+		// restarted while the app is starting
+		sidecar.ReadinessProbe = readinessProbe(a.Config.CoupleReadinessPath)
+	}
+
+	data := templateData{
+		Namespace:   dep.Namespace,
+		Name:        dep.Name,
+		Labels:      dep.Labels,
+		Annotations: dep.Annotations,
+	}
+	var err error
+	if sidecar.Command, err = renderTemplates(command, data); err != nil {
+		return core.Container{}, fmt.Errorf("sidecar command: %v", err)
+	}
+	if sidecar.Args, err = renderTemplates(args, data); err != nil {
+		return core.Container{}, fmt.Errorf("sidecar args: %v", err)
+	}
+	return sidecar, nil
+}
+
+// sidecarSummary describes the injected sidecar in one line, for the
+// SidecarInjected event.
+func sidecarSummary(sidecar core.Container, hash string) string {
+	var ports []string
+	for _, port := range sidecar.Ports {
+		ports = append(ports, fmt.Sprintf("%d/%s", port.ContainerPort, port.Protocol))
+	}
+	summary := fmt.Sprintf("injected %s with image %s", sidecar.Name, sidecar.Image)
+	if len(ports) > 0 {
+		summary += ", ports " + strings.Join(ports, ",")
+	}
+	if len(sidecar.Resources.Requests) > 0 {
+		summary += ", requests " + resourceList(sidecar.Resources.Requests)
+	}
+	if len(sidecar.Resources.Limits) > 0 {
+		summary += ", limits " + resourceList(sidecar.Resources.Limits)
+	}
+	return summary + ", config hash " + hash
+}
+
+// resourceList formats list as name=quantity pairs sorted by name.
+func resourceList(list core.ResourceList) string {
+	var pairs []string
+	for name, quantity := range list {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, quantity.String()))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// renderTemplates renders each of texts as a Go template with data.
+func renderTemplates(texts []string, data templateData) ([]string, error) {
+	var out []string
+	for _, text := range texts {
+		tmpl, err := template.New("sidecar").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		out = append(out, buf.String())
+	}
+	return out, nil
+}
+
+func sideCarContainer(image string) core.Container {
+	return core.Container{
+		Image: image,
+		Name:  sidecarName,
+		Ports: []core.ContainerPort{
+			core.ContainerPort{
+				ContainerPort: sidecarPort,
+				Protocol:      "TCP",
+			},
+		},
+	}
+}
+
+// sidecarIndex returns the index of the sidecar container, or -1 if the
+// pod doesn't run it.
+func sidecarIndex(spec *core.PodSpec) int {
+	for i, container := range spec.Containers {
+		if container.Name == sidecarName {
+			return i
+		}
+	}
+	return -1
+}
+
+// injection is the outcome of applySidecar.
+type injection struct {
+	Sidecar core.Container
+	// Reason is why the sidecar was not injected, and Err what made the
+	// sidecar policy or template invalid.
+	Reason string
+	Err    error
+	// Foreign is the other injector instance that injected the sidecar.
+	Foreign string
+
+	HadSidecar, Injected, Removed bool
+	// SidecarChanged is set when the sidecar container itself was added or
+	// replaced, not only what it needs around it.
+	SidecarChanged bool
+}
+
+// applySidecar injects the sidecar into dep, updates it or, if dep opted out
+// and -remove-on-opt-out is set, removes it again, and records the outcome in
+// inj. It reports whether dep
+// changed.
+func (a *MyReconciler) applySidecar(dep *deployment, inj *injection) bool {
+	inj.Sidecar, inj.Reason, inj.Err = a.evaluate(dep)
+	if inj.Reason == skipAdmissionDenied {
+		// any write of this generation is denied, even the skip reason
+		return false
+	}
+	inj.Foreign = a.foreignInjector(dep)
+	inj.HadSidecar = sidecarIndex(&dep.Template.Spec) >= 0
+	hash := dep.Annotations[sidecarHashAnnotation]
+	inj.Injected = inj.Reason == "" && a.inject(dep, inj.Sidecar)
+	inj.SidecarChanged = inj.Injected && dep.Annotations[sidecarHashAnnotation] != hash
+	// only a definite opt-out takes the sidecar away again, an opt-in that
+	// couldn't be read has a reason of its own
+	inj.Removed = inj.Reason == skipSelectorMismatch && a.Config.RemoveOnOptOut && a.remove(dep)
+	changed := inj.Injected || inj.Removed
+	if inj.Reason == "" && setInjectedBy(dep, a.Config.InstanceID) {
+		changed = true
+	}
+	if inj.Reason == "" && a.Config.GitOpsIgnore && setGitOpsIgnore(dep) {
+		changed = true
+	}
+	if a.Config.AnnotateSkipReason && setSkipReason(dep, inj.Reason) {
+		changed = true
+	}
+	return changed
+}
+
+// inject adds sidecar and everything it needs to dep's pod template. It
+// reports whether dep changed.
+func (a *MyReconciler) inject(dep *deployment, sidecar core.Container) bool {
+	spec := &dep.Template.Spec
+	changed := a.injectSidecar(dep, sidecar)
+	if a.Config.SetServiceAccount && spec.ServiceAccountName == "" {
+		spec.ServiceAccountName = a.Config.RequireServiceAccount
+		changed = true
+	}
+	if a.Config.PrewarmSidecar && injectPrewarm(spec, prewarmContainer(sidecar, a.Config.PrewarmCommand)) {
+		changed = true
+	}
+	if a.Config.SidecarFSGroup >= 0 && injectFSGroup(spec, a.Config.SidecarFSGroup) {
+		changed = true
+	}
+	if a.Config.LogSidecar && injectLogVolume(spec, a.Config.LogSidecarPath, a.Config.PrimaryContainer) {
+		changed = true
+	}
+	if a.Config.CoupleReadiness && injectReadinessVolume(spec, a.Config.CoupleReadinessPath, a.Config.PrimaryContainer) {
+		changed = true
+	}
+	return changed
+}
+
+// injectSidecar adds sidecar to dep, or replaces the injected sidecar when its
+// config changed since it was injected. The config is tracked as a hash in
+// dep's annotations rather than by comparing containers, as the API server
+// fills in defaults the desired sidecar doesn't have. With -reinject-on-drift
+// the containers are compared as well, on the fields the desired sidecar
+// sets. It reports whether dep changed.
+func (a *MyReconciler) injectSidecar(dep *deployment, sidecar core.Container) bool {
+	spec := &dep.Template.Spec
+	hash := sidecarHash(sidecar)
+	last, known := dep.Annotations[sidecarHashAnnotation]
+	i := sidecarIndex(spec)
+	switch {
+	case i < 0:
+		spec.Containers = append(spec.Containers, sidecar)
+	case last != hash, a.Config.ReinjectOnDrift && drifted(spec.Containers[i], sidecar):
+		// the image channel, the flags or the template data moved on, or
+		// someone edited the sidecar
+		spec.Containers[i] = sidecar
+		if known && a.Config.RestartAnnotation != "" {
+			setRestartAnnotation(dep.Template, a.Config.RestartAnnotation)
+		}
+	default:
+		// don't inject if sidecar is already in the deployment
+		return false
+	}
+	if dep.Annotations == nil {
+		dep.Annotations = map[string]string{}
+	}
+	dep.Annotations[sidecarHashAnnotation] = hash
+	return true
+}
+
+// remove takes the sidecar and what was injected along with it out of dep
+// again, as long as it was put there by this injector as recorded in the
+// config-hash annotation. Service accounts and fsGroups set for the sidecar
+// stay, as the app may depend on them by now. It reports whether dep changed.
+func (a *MyReconciler) remove(dep *deployment) bool {
+	if _, injected := dep.Annotations[sidecarHashAnnotation]; !injected {
+		return false
+	}
+	if a.Config.ForeignInjector == foreignSkip && a.foreignInjector(dep) != "" {
+		return false
+	}
+	spec := &dep.Template.Spec
+	if i := sidecarIndex(spec); i >= 0 {
+		spec.Containers = append(spec.Containers[:i], spec.Containers[i+1:]...)
+	}
+	removePrewarm(spec)
+	removeLogVolume(spec)
+	removeReadinessVolume(spec)
+	delete(dep.Annotations, sidecarHashAnnotation)
+	delete(dep.Annotations, injectedByAnnotation)
+	delete(dep.Annotations, gitOpsIgnoreAnnotation)
+	if a.Config.RestartOnRemoval {
+		setRestartAnnotation(dep.Template, a.Config.RestartAnnotation)
+	}
+	return true
+}
+
+// setRestartAnnotation sets the annotation name of template to the current
+// time.
+func setRestartAnnotation(template *core.PodTemplateSpec, name string) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[name] = time.Now().Format(time.RFC3339)
+}
+
+// injectFSGroup sets the fsGroup of spec unless it has one already, as the app
+// containers depend on the existing one. It reports whether spec changed.
+func injectFSGroup(spec *core.PodSpec, group int64) bool {
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = &core.PodSecurityContext{}
+	}
+	if spec.SecurityContext.FSGroup != nil {
+		return false
+	}
+	spec.SecurityContext.FSGroup = &group
+	return true
+}
+
+// primaryContainer returns the app container the sidecar is configured
+// against: the container called name, or the first app container when name is
+// empty. It returns nil if there is no such container.
+func primaryContainer(spec *core.PodSpec, name string) *core.Container {
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name != sidecarName && (name == "" || container.Name == name) {
+			return container
+		}
+	}
+	return nil
+}
+
+// proportionalResources returns ratio of the CPU and memory of primary, the
+// requests only with requestsOnly.
+func proportionalResources(primary core.ResourceRequirements, ratio float64, requestsOnly bool) core.ResourceRequirements {
+	scale := func(list core.ResourceList) core.ResourceList {
+		var scaled core.ResourceList
+		for _, name := range []core.ResourceName{core.ResourceCPU, core.ResourceMemory} {
+			quantity, found := list[name]
+			if !found {
+				continue
+			}
+			if scaled == nil {
+				scaled = core.ResourceList{}
+			}
+			milli := int64(float64(quantity.MilliValue()) * ratio)
+			if name == core.ResourceMemory {
+				// memory in fractions of a byte can't be requested
+				scaled[name] = *resource.NewQuantity(milli/1000, quantity.Format)
+			} else {
+				scaled[name] = *resource.NewMilliQuantity(milli, quantity.Format)
+			}
+		}
+		return scaled
+	}
+	resources := core.ResourceRequirements{Requests: scale(primary.Requests)}
+	if !requestsOnly {
+		resources.Limits = scale(primary.Limits)
+	}
+	return resources
+}
+
+// mergeResources returns base with every resource set in override replaced.
+func mergeResources(base, override core.ResourceRequirements) core.ResourceRequirements {
+	merge := func(base, override core.ResourceList) core.ResourceList {
+		for name, quantity := range override {
+			if base == nil {
+				base = core.ResourceList{}
+			}
+			base[name] = quantity
+		}
+		return base
+	}
+	return core.ResourceRequirements{
+		Requests: merge(base.Requests, override.Requests),
+		Limits:   merge(base.Limits, override.Limits),
+	}
+}
+
+// sidecarHash returns a short hash of the sidecar's config.
+func sidecarHash(sidecar core.Container) string {
+	data, _ := json.Marshal(sidecar)
+	h := fnv.New64a()
+	h.Write(data)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// portInUse reports whether container already exposes one of the sidecar's
+// ports.
+func portInUse(container *core.Container, sidecar core.Container) bool {
+	for _, port := range container.Ports {
+		for _, sidecarPort := range sidecar.Ports {
+			if port.ContainerPort == sidecarPort.ContainerPort && port.Protocol == sidecarPort.Protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
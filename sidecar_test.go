@@ -0,0 +1,245 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestDesiredSidecarLifecycle(t *testing.T) {
+	tests := []struct {
+		name                    string
+		args                    []string
+		wantReadiness, wantLive bool
+		wantPreStop             []string
+	}{
+		{name: "built-in sidecar", wantReadiness: false, wantLive: false},
+		{name: "tcp probe", args: []string{"-sidecar-tcp-probe"}, wantReadiness: true, wantLive: true},
+		{name: "tcp probe, not critical", args: []string{"-sidecar-tcp-probe", "-sidecar-critical=false"}, wantReadiness: true, wantLive: false},
+		{name: "coupled readiness", args: []string{"-couple-readiness"}, wantReadiness: true, wantLive: false},
+		{name: "prestop sleep", args: []string{"-sidecar-prestop-sleep=2500ms"}, wantPreStop: []string{"sleep", "2.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			sidecar, err := a.desiredSidecar(asDeployment(testDeployment("web", nil)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sidecar.ReadinessProbe != nil; got != tt.wantReadiness {
+				t.Errorf("readiness probe = %v, want %v", got, tt.wantReadiness)
+			}
+			if got := sidecar.LivenessProbe != nil; got != tt.wantLive {
+				t.Errorf("liveness probe = %v, want %v", got, tt.wantLive)
+			}
+			var preStop []string
+			if sidecar.Lifecycle != nil && sidecar.Lifecycle.PreStop != nil && sidecar.Lifecycle.PreStop.Exec != nil {
+				preStop = sidecar.Lifecycle.PreStop.Exec.Command
+			}
+			if !equalStrings(preStop, tt.wantPreStop) {
+				t.Errorf("preStop command = %q, want %q", preStop, tt.wantPreStop)
+			}
+		})
+	}
+}
+
+func TestDesiredSidecarHostNetwork(t *testing.T) {
+	a := testReconciler(testConfig(t, "-allow-host-network"))
+	obj := testDeployment("web", nil)
+	obj.Spec.Template.Spec.HostNetwork = true
+	sidecar, err := a.desiredSidecar(asDeployment(obj), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecar.Ports) != 1 || sidecar.Ports[0].HostPort != sidecar.Ports[0].ContainerPort {
+		t.Errorf("ports = %+v, want the sidecar port as host port", sidecar.Ports)
+	}
+}
+
+func TestDesiredSidecarTemplates(t *testing.T) {
+	a := testReconciler(testConfig(t, "-sidecar-args=--service={{ .Namespace }}/{{ .Name }}", "-sidecar-args={{ index .Labels \"tier\" }}"))
+	sidecar, err := a.desiredSidecar(asDeployment(testDeployment("web", map[string]string{"tier": "frontend"})), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--service=default/web", "frontend"}; len(sidecar.Args) != 2 || sidecar.Args[0] != want[0] || sidecar.Args[1] != want[1] {
+		t.Errorf("args = %q, want %q", sidecar.Args, want)
+	}
+
+	a = testReconciler(testConfig(t, "-sidecar-args={{ .Missing }}"))
+	if _, err := a.desiredSidecar(asDeployment(testDeployment("web", nil)), nil); err == nil {
+		t.Errorf("rendering a missing key succeeded")
+	}
+}
+
+func TestDesiredSidecarResources(t *testing.T) {
+	primary := core.ResourceRequirements{
+		Requests: core.ResourceList{core.ResourceCPU: resource.MustParse("1"), core.ResourceMemory: resource.MustParse("1Gi")},
+		Limits:   core.ResourceList{core.ResourceCPU: resource.MustParse("2"), core.ResourceMemory: resource.MustParse("2Gi")},
+	}
+	tests := []struct {
+		name                    string
+		args                    []string
+		wantCPURequest, wantCPU string
+		wantMemRequest, wantMem string
+	}{
+		{name: "none"},
+		{
+			name:           "flags",
+			args:           []string{"-sidecar-cpu-request=50m", "-sidecar-memory-request=32Mi", "-sidecar-cpu-limit=100m", "-sidecar-memory-limit=64Mi"},
+			wantCPURequest: "50m", wantCPU: "100m", wantMemRequest: "32Mi", wantMem: "64Mi",
+		},
+		{
+			name:           "flags, requests only",
+			args:           []string{"-sidecar-cpu-request=50m", "-sidecar-memory-request=32Mi", "-sidecar-cpu-limit=100m", "-sidecar-memory-limit=64Mi", "-sidecar-requests-only"},
+			wantCPURequest: "50m", wantMemRequest: "32Mi",
+		},
+		{name: "quarter", args: []string{"-sidecar-resource-ratio=0.25"}, wantCPURequest: "250m", wantCPU: "500m", wantMemRequest: "256Mi", wantMem: "512Mi"},
+		{
+			name:           "flag wins",
+			args:           []string{"-sidecar-resource-ratio=0.25", "-sidecar-cpu-request=100m"},
+			wantCPURequest: "100m", wantCPU: "500m", wantMemRequest: "256Mi", wantMem: "512Mi",
+		},
+		{name: "requests only", args: []string{"-sidecar-resource-ratio=0.25", "-sidecar-requests-only"}, wantCPURequest: "250m", wantMemRequest: "256Mi"},
+		{name: "named primary", args: []string{"-sidecar-resource-ratio=0.5", "-primary-container=worker"}, wantCPURequest: "50m", wantMemRequest: "64Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			obj := testDeployment("web", nil)
+			obj.Spec.Template.Spec.Containers[0].Resources = primary
+			obj.Spec.Template.Spec.Containers = append(obj.Spec.Template.Spec.Containers, core.Container{
+				Name:      "worker",
+				Resources: core.ResourceRequirements{Requests: core.ResourceList{core.ResourceCPU: resource.MustParse("100m"), core.ResourceMemory: resource.MustParse("128Mi")}},
+			})
+			sidecar, err := a.desiredSidecar(asDeployment(obj), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range []struct {
+				list core.ResourceList
+				name core.ResourceName
+				want string
+			}{
+				{sidecar.Resources.Requests, core.ResourceCPU, tt.wantCPURequest},
+				{sidecar.Resources.Limits, core.ResourceCPU, tt.wantCPU},
+				{sidecar.Resources.Requests, core.ResourceMemory, tt.wantMemRequest},
+				{sidecar.Resources.Limits, core.ResourceMemory, tt.wantMem},
+			} {
+				got, found := q.list[q.name]
+				if q.want == "" {
+					if found {
+						t.Errorf("%s = %s, want none", q.name, got.String())
+					}
+					continue
+				}
+				if want := resource.MustParse(q.want); got.Cmp(want) != 0 {
+					t.Errorf("%s = %s, want %s", q.name, got.String(), q.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectSidecar(t *testing.T) {
+	const restart = "example.com/restartedAt"
+	a := testReconciler(testConfig(t, "-restart-annotation="+restart))
+	dep := asDeployment(testDeployment("web", nil))
+	sidecar := sideCarContainer("node-demo:1")
+
+	if !a.injectSidecar(dep, sidecar) {
+		t.Fatalf("sidecar not injected")
+	}
+	if a.injectSidecar(dep, sidecar) {
+		t.Errorf("unchanged sidecar injected again")
+	}
+	if _, found := dep.Template.Annotations[restart]; found {
+		t.Errorf("restart annotation set on the first injection")
+	}
+
+	sidecar.Image = "node-demo:2"
+	if !a.injectSidecar(dep, sidecar) {
+		t.Fatalf("changed sidecar not re-injected")
+	}
+	if got := dep.Template.Spec.Containers[sidecarIndex(&dep.Template.Spec)].Image; got != sidecar.Image {
+		t.Errorf("image = %q, want %q", got, sidecar.Image)
+	}
+	if _, found := dep.Template.Annotations[restart]; !found {
+		t.Errorf("restart annotation not set on re-injection")
+	}
+	if n := len(dep.Template.Spec.Containers); n != 2 {
+		t.Errorf("got %d containers, want the app and one sidecar", n)
+	}
+}
+
+func TestInjectSidecarDrift(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "hash only", want: false},
+		{name: "reinject on drift", args: []string{"-reinject-on-drift"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			dep := asDeployment(testDeployment("web", nil))
+			sidecar := sideCarContainer("node-demo:1")
+			a.injectSidecar(dep, sidecar)
+			// edited by hand
+			dep.Template.Spec.Containers[sidecarIndex(&dep.Template.Spec)].Image = "node-demo:debug"
+			if got := a.injectSidecar(dep, sidecar); got != tt.want {
+				t.Errorf("injectSidecar() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySidecarInjectedBy(t *testing.T) {
+	a := testReconciler(testConfig(t, "-instance-id=injector-a", "-gitops-ignore"))
+	dep := asDeployment(testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	var inj injection
+	if !a.applySidecar(dep, &inj) || !inj.Injected || !inj.SidecarChanged {
+		t.Fatalf("applySidecar() didn't inject: %+v", inj)
+	}
+	if got := dep.Annotations[injectedByAnnotation]; got != "injector-a" {
+		t.Errorf("injected-by = %q, want injector-a", got)
+	}
+	if got := dep.Annotations[gitOpsIgnoreAnnotation]; got != "true" {
+		t.Errorf("gitops-ignore = %q, want true", got)
+	}
+
+	inj = injection{}
+	if a.applySidecar(dep, &inj) || inj.SidecarChanged {
+		t.Errorf("applying the same sidecar again changed the deployment: %+v", inj)
+	}
+}
+
+func TestPortInUse(t *testing.T) {
+	sidecar := sideCarContainer("node-demo:1")
+	app := core.Container{Ports: []core.ContainerPort{{ContainerPort: 8081, Protocol: "TCP"}}}
+	if !portInUse(&app, sidecar) {
+		t.Errorf("same port not in use")
+	}
+	app.Ports[0].ContainerPort++
+	if portInUse(&app, sidecar) {
+		t.Errorf("other port in use")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// sidecarSource is a YAML container spec the sidecar is built from, named
+// for error messages and logs, e.g. "file /etc/sidecar.yaml".
+type sidecarSource struct {
+	Name string
+	Data []byte
+}
+
+// readSidecarFile reads the -sidecar-config file.
+func readSidecarFile(path string) (sidecarSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return sidecarSource{}, err
+	}
+	return sidecarSource{Name: "file " + path, Data: data}, nil
+}
+
+// readSidecarConfigMap reads the -sidecar-configmap key, written as
+// <namespace>/<name>/<key>.
+func readSidecarConfigMap(reader client.Reader, source string) (sidecarSource, error) {
+	parts := strings.Split(source, "/")
+	cm := &core.ConfigMap{}
+	if err := reader.Get(context.TODO(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, cm); err != nil {
+		return sidecarSource{}, err
+	}
+	data, found := cm.Data[parts[2]]
+	if !found {
+		return sidecarSource{}, fmt.Errorf("configmap %s/%s has no key %s", parts[0], parts[1], parts[2])
+	}
+	return sidecarSource{Name: "configmap " + source, Data: []byte(data)}, nil
+}
+
+// sidecarSources reads the sidecar container specs configured in cfg, ordered
+// so the one named by -sidecar-source-precedence comes last and wins.
+func sidecarSources(reader client.Reader, cfg *Config) ([]sidecarSource, error) {
+	var sources []sidecarSource
+	if cfg.SidecarConfig != "" {
+		source, err := readSidecarFile(cfg.SidecarConfig)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if cfg.SidecarConfigMap != "" {
+		source, err := readSidecarConfigMap(reader, cfg.SidecarConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if cfg.SidecarSourcePrecedence == precedenceFile && len(sources) == 2 {
+		sources[0], sources[1] = sources[1], sources[0]
+	}
+	return sources, nil
+}
+
+// loadSidecarBase merges the container specs the sidecar is built from, every
+// source overriding the top-level fields of the ones before it, e.g. a file
+// seeding the defaults and a ConfigMap setting the image. It returns the
+// container and the source each field came from. The merged spec is validated
+// and normalized here, so a malformed container is rejected at startup rather
+// than sent with every injection.
+func loadSidecarBase(sources ...sidecarSource) (*core.Container, map[string]string, error) {
+	var names []string
+	merged := map[string]interface{}{}
+	fields := map[string]string{}
+	for _, source := range sources {
+		names = append(names, source.Name)
+		// decode strictly on its own first, so errors point at the source, and
+		// merge the re-encoded container so field names are canonical
+		container := &core.Container{}
+		if err := yaml.UnmarshalStrict(source.Data, container); err != nil {
+			return nil, nil, fmt.Errorf("invalid sidecar spec in %s: %v", source.Name, err)
+		}
+		data, err := json.Marshal(container)
+		if err != nil {
+			return nil, nil, err
+		}
+		spec := map[string]interface{}{}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, nil, err
+		}
+		for name, value := range spec {
+			if empty(value) {
+				// name and resources are encoded even when not set
+				continue
+			}
+			merged[name] = value
+			fields[name] = source.Name
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	container := &core.Container{}
+	if err := json.Unmarshal(data, container); err != nil {
+		return nil, nil, fmt.Errorf("invalid sidecar spec merged from %s: %v", strings.Join(names, ", "), err)
+	}
+	if errs := validateSidecarBase(container); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid sidecar spec merged from %s: %v", strings.Join(names, ", "), errs.ToAggregate())
+	}
+	normalizeSidecarBase(container)
+	return container, fields, nil
+}
+
+// empty reports whether a decoded JSON value is an empty string or object.
+func empty(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// validateSidecarBase checks the fields the injector relies on.
+func validateSidecarBase(container *core.Container) field.ErrorList {
+	var errs field.ErrorList
+	switch container.Name {
+	case "":
+		errs = append(errs, field.Required(field.NewPath("name"), ""))
+	case sidecarName:
+	default:
+		// the injected sidecar is found by its name
+		errs = append(errs, field.Invalid(field.NewPath("name"), container.Name, "must be "+sidecarName))
+	}
+	if container.Image == "" {
+		errs = append(errs, field.Required(field.NewPath("image"), ""))
+	}
+	switch container.ImagePullPolicy {
+	case "", core.PullAlways, core.PullIfNotPresent, core.PullNever:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("imagePullPolicy"), container.ImagePullPolicy,
+			[]string{string(core.PullAlways), string(core.PullIfNotPresent), string(core.PullNever)}))
+	}
+	for i, port := range container.Ports {
+		path := field.NewPath("ports").Index(i)
+		for _, msg := range validation.IsValidPortNum(int(port.ContainerPort)) {
+			errs = append(errs, field.Invalid(path.Child("containerPort"), port.ContainerPort, msg))
+		}
+		if port.Name != "" {
+			for _, msg := range validation.IsValidPortName(port.Name) {
+				errs = append(errs, field.Invalid(path.Child("name"), port.Name, msg))
+			}
+		}
+		switch port.Protocol {
+		case "", core.ProtocolTCP, core.ProtocolUDP, core.ProtocolSCTP:
+		default:
+			errs = append(errs, field.NotSupported(path.Child("protocol"), port.Protocol,
+				[]string{string(core.ProtocolTCP), string(core.ProtocolUDP), string(core.ProtocolSCTP)}))
+		}
+	}
+	return errs
+}
+
+// normalizeSidecarBase fills in the defaults the API server would, so the
+// injected sidecar looks the same before and after it was stored.
+func normalizeSidecarBase(container *core.Container) {
+	for i := range container.Ports {
+		if container.Ports[i].Protocol == "" {
+			container.Ports[i].Protocol = core.ProtocolTCP
+		}
+	}
+	if container.ImagePullPolicy == "" {
+		container.ImagePullPolicy = defaultPullPolicy(container.Image)
+	}
+}
+
+// defaultPullPolicy returns the pull policy the API server defaults image to:
+// Always for latest or untagged images, IfNotPresent otherwise.
+func defaultPullPolicy(image string) core.PullPolicy {
+	name := image
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		// pinned by digest
+		return core.PullIfNotPresent
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i < 0 || name[i+1:] == "latest" {
+		return core.PullAlways
+	}
+	return core.PullIfNotPresent
+}
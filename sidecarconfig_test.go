@@ -0,0 +1,65 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+)
+
+func TestLoadSidecarBase(t *testing.T) {
+	file := sidecarSource{Name: "file sidecar.yaml", Data: []byte("name: node-sidecar\nimage: node-demo:1\nports:\n- containerPort: 9000\n")}
+	configMap := sidecarSource{Name: "configmap ops/sidecar/spec", Data: []byte("image: node-demo:2\n")}
+	tests := []struct {
+		name       string
+		sources    []sidecarSource
+		wantImage  string
+		wantPolicy core.PullPolicy
+		wantFrom   string
+		wantErr    bool
+	}{
+		{name: "file", sources: []sidecarSource{file}, wantImage: "node-demo:1", wantPolicy: core.PullIfNotPresent, wantFrom: file.Name},
+		{name: "configmap overrides the image", sources: []sidecarSource{file, configMap}, wantImage: "node-demo:2", wantPolicy: core.PullIfNotPresent, wantFrom: configMap.Name},
+		{name: "untagged image", sources: []sidecarSource{{Name: "a", Data: []byte("name: node-sidecar\nimage: node-demo\n")}}, wantImage: "node-demo", wantPolicy: core.PullAlways, wantFrom: "a"},
+		{name: "unknown field", sources: []sidecarSource{{Name: "a", Data: []byte("name: node-sidecar\nimage: x:1\nimagePolcy: Always\n")}}, wantErr: true},
+		{name: "wrong name", sources: []sidecarSource{{Name: "a", Data: []byte("name: sidecar\nimage: x:1\n")}}, wantErr: true},
+		{name: "no image", sources: []sidecarSource{{Name: "a", Data: []byte("name: node-sidecar\n")}}, wantErr: true},
+		{name: "bad port", sources: []sidecarSource{{Name: "a", Data: []byte("name: node-sidecar\nimage: x:1\nports:\n- containerPort: 70000\n")}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container, fields, err := loadSidecarBase(tt.sources...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSidecarBase() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if container.Image != tt.wantImage || container.ImagePullPolicy != tt.wantPolicy {
+				t.Errorf("image %s pulled %s, want %s pulled %s", container.Image, container.ImagePullPolicy, tt.wantImage, tt.wantPolicy)
+			}
+			if fields["image"] != tt.wantFrom {
+				t.Errorf("image from %q, want %q", fields["image"], tt.wantFrom)
+			}
+			for _, port := range container.Ports {
+				if port.Protocol != core.ProtocolTCP {
+					t.Errorf("port %d protocol %q, want it defaulted to TCP", port.ContainerPort, port.Protocol)
+				}
+			}
+		})
+	}
+}
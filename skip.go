@@ -0,0 +1,345 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// skipReasonAnnotation records why the sidecar was not injected.
+const skipReasonAnnotation = "node-sidecar/skip-reason"
+
+// optedIn reports whether dep asked for the sidecar with its node-sidecar
+// label, or, with namespace injection, lives in a namespace that did and
+// doesn't set the label itself. With policies a Deployment opts in by being
+// selected by a SidecarPolicy instead. A namespace missing from the cache is
+// an error, not an opt-out.
+func (a *MyReconciler) optedIn(dep *deployment) (bool, error) {
+	if a.Config.EnablePolicies {
+		policy, err := a.policyFor(dep)
+		return policy != nil, err
+	}
+	if val, found := dep.Labels["node-sidecar"]; found {
+		return val == "true", nil
+	}
+	if !a.Config.NamespaceInjection {
+		return false, nil
+	}
+	ns := &core.Namespace{}
+	if err := a.Get(context.TODO(), types.NamespacedName{Name: dep.Namespace}, ns); err != nil {
+		return false, err
+	}
+	return namespaceEnabled(ns), nil
+}
+
+// pausedAnnotation set to "true" makes the injector leave a Deployment alone
+// entirely, e.g. while it is being debugged.
+const pausedAnnotation = "node-sidecar/paused"
+
+// paused reports whether dep is paused.
+func paused(dep *deployment) bool {
+	return dep.Annotations[pausedAnnotation] == "true"
+}
+
+// clustersAnnotation limits a Deployment to the comma separated clusters, for
+// fleets applying the same manifests to every cluster.
+const clustersAnnotation = "node-sidecar/clusters"
+
+// Reasons for not injecting the sidecar, as written to skipReasonAnnotation.
+const (
+	skipSelectorMismatch = "selector-mismatch"
+	skipHostNetwork      = "host-network"
+	skipPortConflict     = "port-conflict"
+	skipPrimaryMissing   = "primary-container-missing"
+	skipTemplateError    = "template-error"
+	skipAdmissionDenied  = "admission-denied"
+	skipInactiveRevision = "inactive-revision"
+	skipOwnerMismatch    = "owner-mismatch"
+	skipServiceAccount   = "service-account-mismatch"
+	skipForeignInjector  = "foreign-injector"
+	skipClusterMismatch  = "cluster-mismatch"
+	skipEnvPresent       = "env-present"
+	skipImageUnverified  = "image-unverified"
+	skipPaused           = "paused"
+	skipPolicyError      = "policy-error"
+	skipPolicyInvalid    = "policy-invalid"
+	skipNamespaceUnknown = "namespace-unknown"
+	skipSelf             = "self"
+)
+
+// evaluate decides whether dep gets the sidecar. It returns the sidecar to
+// inject, or the reason dep is skipped. When the sidecar policy of dep is
+// invalid, or the sidecar can't be rendered for dep, the reason is
+// skipPolicyInvalid or skipTemplateError and the error is returned. A sidecar
+// whose image wasn't verified is returned with skipImageUnverified.
+func (a *MyReconciler) evaluate(dep *deployment) (core.Container, string, error) {
+	if reason := a.policyReason(dep); reason != "" {
+		return core.Container{}, reason, nil
+	}
+	base, err := a.sidecarBase(dep)
+	if err != nil {
+		return core.Container{}, skipPolicyInvalid, err
+	}
+	sidecar, err := a.desiredSidecar(dep, base)
+	if err != nil {
+		return core.Container{}, skipTemplateError, err
+	}
+	if a.Verifier != nil && !a.Verifier.exists(dep, sidecar.Image) {
+		// pods couldn't pull it
+		return sidecar, skipImageUnverified, nil
+	}
+	return sidecar, a.skipReason(dep, sidecar), nil
+}
+
+// policyReason returns why dep is not selected for the sidecar at all, or ""
+// if it is.
+func (a *MyReconciler) policyReason(dep *deployment) string {
+	if a.Denials.denied(types.NamespacedName{Namespace: dep.Namespace, Name: dep.Name}, dep.Generation) {
+		// retrying the same spec would only be denied again, whatever we
+		// meant to change
+		return skipAdmissionDenied
+	}
+	opted, err := a.optedIn(dep)
+	if err != nil {
+		// not knowing isn't opting out, keep whatever was injected
+		a.Log.Error(err, "could not tell whether deployment opted in", "deployment", types.NamespacedName{Namespace: dep.Namespace, Name: dep.Name})
+		if a.Config.EnablePolicies {
+			return skipPolicyError
+		}
+		return skipNamespaceUnknown
+	}
+	if !opted {
+		return skipSelectorMismatch
+	}
+	if a.Self.Name != "" && a.Self == (types.NamespacedName{Namespace: dep.Namespace, Name: dep.Name}) {
+		// restarting our own pods for the sidecar would restart us in a loop
+		return skipSelf
+	}
+	if a.Config.ForeignInjector == foreignSkip && a.foreignInjector(dep) != "" {
+		// leave it to the injector that put the sidecar there
+		return skipForeignInjector
+	}
+	if clusters, found := dep.Annotations[clustersAnnotation]; found && a.Config.ClusterName != "" && !listed(clusters, a.Config.ClusterName) {
+		return skipClusterMismatch
+	}
+	if name := a.Config.ActiveRevisionAnnotation; name != "" && dep.Annotations[name] != "true" {
+		// only the active revision of a blue/green pair gets the sidecar
+		return skipInactiveRevision
+	}
+	if kind, name := a.Config.RequireOwnerKind, a.Config.RequireOwnerName; (kind != "" || name != "") && !ownedBy(dep.ObjectMeta, kind, name) {
+		return skipOwnerMismatch
+	}
+	if name := a.Config.RequireServiceAccount; name != "" {
+		account := dep.Template.Spec.ServiceAccountName
+		if account != name && !(account == "" && a.Config.SetServiceAccount) {
+			return skipServiceAccount
+		}
+	}
+	return ""
+}
+
+// injectedByAnnotation records the instance-id of the injector that last
+// injected the sidecar, so two injectors working on the same Deployment show.
+const injectedByAnnotation = "node-sidecar/injected-by"
+
+// What to do with a Deployment injected by another injector instance.
+const (
+	foreignAdopt = "adopt"
+	foreignSkip  = "skip"
+)
+
+// foreignInjector returns the instance-id of the injector that injected dep
+// when that isn't this instance, or "" otherwise.
+func (a *MyReconciler) foreignInjector(dep *deployment) string {
+	if id := dep.Annotations[injectedByAnnotation]; id != "" && id != a.Config.InstanceID {
+		return id
+	}
+	return ""
+}
+
+// setInjectedBy writes id to obj's injected-by annotation. It reports whether
+// the annotations changed.
+func setInjectedBy(obj metav1.Object, id string) bool {
+	annotations := obj.GetAnnotations()
+	if annotations[injectedByAnnotation] == id {
+		return false
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[injectedByAnnotation] = id
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// listed reports whether name is in the comma separated list.
+func listed(list, name string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// managedByLabel is the recommended label naming the tool managing an object.
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+// ownedBy reports whether meta has an owner reference matching kind and name,
+// either of which may be empty to match any. Tools that don't set owner
+// references, like most GitOps controllers, are matched by the managed-by
+// label against name, or kind when no name is given.
+func ownedBy(meta *metav1.ObjectMeta, kind, name string) bool {
+	for _, ref := range meta.OwnerReferences {
+		if (kind == "" || ref.Kind == kind) && (name == "" || ref.Name == name) {
+			return true
+		}
+	}
+	managedBy := name
+	if managedBy == "" {
+		managedBy = kind
+	}
+	return strings.EqualFold(meta.Labels[managedByLabel], managedBy)
+}
+
+// skipReason returns why sidecar should not be injected into the selected
+// dep, or "" if it should be.
+func (a *MyReconciler) skipReason(dep *deployment, sidecar core.Container) string {
+	spec := &dep.Template.Spec
+	if name := a.Config.PrimaryContainer; name != "" && primaryContainer(spec, name) == nil {
+		// it would be sized and wired against a container that isn't there,
+		// most likely the Deployment renamed it or uses another name
+		return skipPrimaryMissing
+	}
+	if sidecarIndex(spec) >= 0 {
+		// already injected, keep it up to date
+		return ""
+	}
+	if name := a.Config.SkipIfEnv; name != "" && setsEnv(spec, name) {
+		// the app already handles what the sidecar is for
+		return skipEnvPresent
+	}
+	if spec.HostNetwork && !a.Config.AllowHostNetwork {
+		// the sidecar port could collide with the node
+		return skipHostNetwork
+	}
+	if portsInUse(spec, sidecar) {
+		// the sidecar would not be able to bind its port
+		return skipPortConflict
+	}
+	return ""
+}
+
+// portsInUse reports whether an app container of spec already exposes one of
+// the sidecar's ports. Init containers have run to completion by the time the
+// sidecar starts, so their ports are free again.
+func portsInUse(spec *core.PodSpec, sidecar core.Container) bool {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name != sidecarName && portInUse(&spec.Containers[i], sidecar) {
+			return true
+		}
+	}
+	return false
+}
+
+// setsEnv reports whether an app container of spec sets the environment
+// variable name. Variables from envFrom sources can't be seen here.
+func setsEnv(spec *core.PodSpec, name string) bool {
+	for _, container := range spec.Containers {
+		if container.Name == sidecarName {
+			continue
+		}
+		for _, env := range container.Env {
+			if env.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setSkipReason writes reason to obj's skip-reason annotation, removing it
+// when reason is empty. It reports whether the annotations changed.
+func setSkipReason(obj metav1.Object, reason string) bool {
+	annotations := obj.GetAnnotations()
+	if annotations[skipReasonAnnotation] == reason {
+		return false
+	}
+	if reason == "" {
+		if _, found := annotations[skipReasonAnnotation]; !found {
+			return false
+		}
+		delete(annotations, skipReasonAnnotation)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[skipReasonAnnotation] = reason
+	}
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// isAdmissionDenied reports whether err is an admission webhook rejecting the
+// request, which won't go away by retrying the same object.
+func isAdmissionDenied(err error) bool {
+	return apierrors.IsForbidden(err) && strings.Contains(err.Error(), "admission webhook")
+}
+
+// admissionDenials remembers the generation of every Deployment whose
+// injection was denied by an admission webhook.
+type admissionDenials struct {
+	mu          sync.Mutex
+	generations map[types.NamespacedName]int64
+}
+
+func newAdmissionDenials() *admissionDenials {
+	return &admissionDenials{generations: map[types.NamespacedName]int64{}}
+}
+
+// deny records that injecting into generation of key was denied.
+func (d *admissionDenials) deny(key types.NamespacedName, generation int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generations[key] = generation
+}
+
+// denied reports whether injecting into generation of key was denied. A new
+// generation clears the denial.
+func (d *admissionDenials) denied(key types.NamespacedName, generation int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	denied, found := d.generations[key]
+	if found && denied != generation {
+		delete(d.generations, key)
+		return false
+	}
+	return found
+}
+
+// forget drops key, e.g. because the Deployment was deleted.
+func (d *admissionDenials) forget(key types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.generations, key)
+}
@@ -0,0 +1,242 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPolicyReason(t *testing.T) {
+	optedIn := map[string]string{"node-sidecar": "true"}
+	tests := []struct {
+		name        string
+		args        []string
+		labels      map[string]string
+		annotations map[string]string
+		self        bool
+		denied      bool
+		want        string
+	}{
+		{name: "opted in", labels: optedIn, want: ""},
+		{name: "no label", want: skipSelectorMismatch},
+		{name: "label false", labels: map[string]string{"node-sidecar": "false"}, want: skipSelectorMismatch},
+		{name: "namespace unknown", args: []string{"-namespace-injection"}, want: skipNamespaceUnknown},
+		{name: "self", labels: optedIn, self: true, want: skipSelf},
+		{name: "denied before opt-out", denied: true, want: skipAdmissionDenied},
+		{
+			name:        "foreign injector",
+			args:        []string{"-foreign-injector=skip", "-instance-id=a"},
+			labels:      optedIn,
+			annotations: map[string]string{injectedByAnnotation: "b"},
+			want:        skipForeignInjector,
+		},
+		{
+			name:        "own injection",
+			args:        []string{"-foreign-injector=skip", "-instance-id=a"},
+			labels:      optedIn,
+			annotations: map[string]string{injectedByAnnotation: "a"},
+			want:        "",
+		},
+		{
+			name:        "other cluster",
+			args:        []string{"-cluster-name=east"},
+			labels:      optedIn,
+			annotations: map[string]string{clustersAnnotation: "west, north"},
+			want:        skipClusterMismatch,
+		},
+		{
+			name:        "listed cluster",
+			args:        []string{"-cluster-name=east"},
+			labels:      optedIn,
+			annotations: map[string]string{clustersAnnotation: "west, east"},
+			want:        "",
+		},
+		{name: "inactive revision", args: []string{"-active-revision-annotation=example.com/active"}, labels: optedIn, want: skipInactiveRevision},
+		{
+			name:        "active revision",
+			args:        []string{"-active-revision-annotation=example.com/active"},
+			labels:      optedIn,
+			annotations: map[string]string{"example.com/active": "true"},
+			want:        "",
+		},
+		{name: "owner mismatch", args: []string{"-require-owner-kind=Application"}, labels: optedIn, want: skipOwnerMismatch},
+		{
+			name:   "managed by owner",
+			args:   []string{"-require-owner-kind=Application"},
+			labels: map[string]string{"node-sidecar": "true", managedByLabel: "application"},
+			want:   "",
+		},
+		{name: "service account mismatch", args: []string{"-require-service-account=mesh"}, labels: optedIn, want: skipServiceAccount},
+		{name: "service account set", args: []string{"-require-service-account=mesh", "-set-service-account"}, labels: optedIn, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			obj := testDeployment("web", tt.labels)
+			obj.Annotations = tt.annotations
+			key := types.NamespacedName{Namespace: obj.Namespace, Name: obj.Name}
+			if tt.self {
+				a.Self = key
+			}
+			if tt.denied {
+				a.Denials.deny(key, obj.Generation)
+			}
+			if got := a.policyReason(asDeployment(obj)); got != tt.want {
+				t.Errorf("policyReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	sidecar := sideCarContainer("node-demo:1")
+	tests := []struct {
+		name string
+		args []string
+		spec core.PodSpec
+		want string
+	}{
+		{name: "free port", spec: core.PodSpec{Containers: []core.Container{{Name: "app"}}}, want: ""},
+		{
+			name: "port of the first container",
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app", Ports: sidecar.Ports}}},
+			want: skipPortConflict,
+		},
+		{
+			name: "port of another container",
+			args: []string{"-primary-container=app"},
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app"}, {Name: "metrics", Ports: sidecar.Ports}}},
+			want: skipPortConflict,
+		},
+		{
+			name: "port of an init container",
+			spec: core.PodSpec{InitContainers: []core.Container{{Name: "init", Ports: sidecar.Ports}}, Containers: []core.Container{{Name: "app"}}},
+			want: "",
+		},
+		{
+			name: "other protocol",
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app", Ports: []core.ContainerPort{{ContainerPort: 8081, Protocol: "UDP"}}}}},
+			want: "",
+		},
+		{name: "host network", spec: core.PodSpec{HostNetwork: true, Containers: []core.Container{{Name: "app"}}}, want: skipHostNetwork},
+		{name: "host network allowed", args: []string{"-allow-host-network"}, spec: core.PodSpec{HostNetwork: true, Containers: []core.Container{{Name: "app"}}}, want: ""},
+		{
+			name: "env present",
+			args: []string{"-skip-if-env=PROXY"},
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app", Env: []core.EnvVar{{Name: "PROXY", Value: "1"}}}}},
+			want: skipEnvPresent,
+		},
+		{
+			name: "already injected",
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app", Ports: sidecar.Ports}, sidecar}},
+			want: "",
+		},
+		{
+			name: "primary container missing",
+			args: []string{"-primary-container=web"},
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app"}}},
+			want: skipPrimaryMissing,
+		},
+		{
+			name: "primary container missing, already injected",
+			args: []string{"-primary-container=web"},
+			spec: core.PodSpec{Containers: []core.Container{{Name: "app"}, sidecar}},
+			want: skipPrimaryMissing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testReconciler(testConfig(t, tt.args...))
+			dep := &deployment{ObjectMeta: &metav1.ObjectMeta{Name: "web"}, Template: &core.PodTemplateSpec{Spec: tt.spec}}
+			if got := a.skipReason(dep, sidecar); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileTemplateError(t *testing.T) {
+	a := testReconciler(testConfig(t, "-sidecar-command={{ .Missing }}"), testDeployment("web", map[string]string{"node-sidecar": "true"}))
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-a.Recorder.(*record.FakeRecorder).Events:
+		if !strings.HasPrefix(e, "Warning SidecarTemplateError ") {
+			t.Errorf("event = %q, want a SidecarTemplateError warning", e)
+		}
+	default:
+		t.Errorf("no event for the template error")
+	}
+	if dep := stored(t, a.Client, "web"); sidecarIndex(&dep.Template.Spec) >= 0 {
+		t.Errorf("sidecar injected with a broken template")
+	}
+}
+
+func TestReconcileAnnotatesSkipReason(t *testing.T) {
+	obj := testDeployment("web", map[string]string{"node-sidecar": "true"})
+	obj.Spec.Template.Spec.HostNetwork = true
+	a := testReconciler(testConfig(t, "-annotate-skip-reason"), obj)
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	dep := stored(t, a.Client, "web")
+	if got := dep.Annotations[skipReasonAnnotation]; got != skipHostNetwork {
+		t.Fatalf("skip reason = %q, want %q", got, skipHostNetwork)
+	}
+
+	dep.Template.Spec.HostNetwork = false
+	if err := a.Update(context.TODO(), dep.Object); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reconcile(request("web")); err != nil {
+		t.Fatal(err)
+	}
+	dep = stored(t, a.Client, "web")
+	if _, found := dep.Annotations[skipReasonAnnotation]; found || sidecarIndex(&dep.Template.Spec) < 0 {
+		t.Errorf("annotations = %v, want the sidecar injected and the skip reason removed", dep.Annotations)
+	}
+}
+
+func TestAdmissionDenials(t *testing.T) {
+	key := types.NamespacedName{Namespace: "default", Name: "web"}
+	d := newAdmissionDenials()
+	if d.denied(key, 1) {
+		t.Fatalf("denied before a denial")
+	}
+	d.deny(key, 1)
+	if !d.denied(key, 1) {
+		t.Errorf("denied generation not denied")
+	}
+	if d.denied(key, 2) {
+		t.Errorf("new generation denied")
+	}
+	if d.denied(key, 1) {
+		t.Errorf("denial not cleared by the new generation")
+	}
+	d.deny(key, 2)
+	d.forget(key)
+	if d.denied(key, 2) {
+		t.Errorf("forgotten denial still denied")
+	}
+}
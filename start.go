@@ -0,0 +1,55 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// startWithRetry calls start until it succeeds or fails with an error that
+// isn't recoverable, waiting for backoff between the calls. It gives up with
+// the last error once the backoff steps are used up.
+func startWithRetry(backoff wait.Backoff, log logr.Logger, start func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := start()
+		if err == nil || !recoverable(err) || backoff.Steps < 1 {
+			return err
+		}
+		delay := backoff.Step()
+		log.Error(err, "manager failed, starting it again", "attempt", attempt, "backoff", delay)
+		time.Sleep(delay)
+	}
+}
+
+// recoverable reports whether err is worth starting the manager again for:
+// the API server being briefly unavailable. A lost leader election is not,
+// the injector exits for a new pod to compete for the lease.
+func recoverable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
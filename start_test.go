@@ -0,0 +1,63 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestStartWithRetry(t *testing.T) {
+	unavailable := apierrors.NewServiceUnavailable("api server starting")
+	fatal := errors.New("invalid scheme")
+	// as returned by the manager
+	leaderLost := fmt.Errorf("leader election lost")
+	tests := []struct {
+		name      string
+		steps     int
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "first start", steps: 3, errs: []error{nil}, wantCalls: 1},
+		{name: "recovers", steps: 3, errs: []error{unavailable, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, nil}, wantCalls: 3},
+		{name: "leader election lost", steps: 3, errs: []error{leaderLost, nil}, wantCalls: 1, wantErr: leaderLost},
+		{name: "not recoverable", steps: 3, errs: []error{fatal}, wantCalls: 1, wantErr: fatal},
+		{name: "out of retries", steps: 2, errs: []error{unavailable, unavailable, unavailable, nil}, wantCalls: 3, wantErr: unavailable},
+		{name: "no retries", steps: 0, errs: []error{unavailable}, wantCalls: 1, wantErr: unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := startWithRetry(wait.Backoff{Steps: tt.steps, Duration: 0, Factor: 2}, ctrl.Log.WithName("test"), func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("startWithRetry() = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("start called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}